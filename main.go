@@ -2,17 +2,43 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/sockets"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/docker/go-units"
 )
 
 type kv struct {
@@ -24,14 +50,177 @@ type env map[string]kv
 
 type envs map[string]env
 
+// a network we will deploy to. key is what we use when naming the stack - it is the network name, unless
+// that name is shared with another network, in which case the short id is added to keep it unique
+type targetNetwork struct {
+	id      string
+	name    string
+	key     string
+	peers   int
+	created time.Time
+}
+
+var (
+	serviceList    = flag.Bool("service-list", false, "print the services that would be created (name, network, image) and exit")
+	noDefaultAvoid = flag.Bool("no-default-avoid", false, "do not avoid the ingress network by default")
+	eventWebhook   = flag.String("event-webhook", "", "url to POST service events to, overrides EVENT_WEBHOOK_URL")
+	check          = flag.Bool("check", false, "check config, docker connectivity and swarm status, print what would be targeted, and exit")
+	nodeFilter     = flag.String("node-filter", "", "comma-seperated list of node hostnames to restrict deployment to - every other node is excluded by placement constraint")
+	applyTimeout   = flag.Int("apply-timeout", 30, "seconds each service create/update may take before it is counted as failed")
+	reportFile     = flag.String("report-file", "", "write a json summary of the deploy to this file")
+	purge          = flag.Bool("purge", false, "remove every service composer deployed for STACK_NAME, then exit")
+	confirm        = flag.Bool("yes", false, "confirm --purge, same as CONFIRM_PURGE=1")
+	networkStatus  = flag.Bool("network-status", false, "print driver, subnet, peers and services for each targeted network and exit")
+	prune          = flag.Bool("prune", false, "remove services from STACK_NAME that the current config would not create, then exit")
+	pruneDryRun    = flag.Bool("prune-dry-run", false, "with --prune, only print what would be removed")
+	stackOverride  = flag.String("stack-name-override", "", "use this instead of the STACK_NAME from the .env file")
+)
+
+// the docker calls composer makes - *client.Client satisfies this, and the tests use a fake
+type dockerAPI interface {
+	Info(ctx context.Context) (types.Info, error)
+	SwarmInspect(ctx context.Context) (swarm.Swarm, error)
+	NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error)
+	NetworkInspect(ctx context.Context, networkID string) (types.NetworkResource, error)
+	NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error)
+	NodeInspectWithRaw(ctx context.Context, nodeID string) (swarm.Node, []byte, error)
+	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error)
+	ServiceCreate(ctx context.Context, service swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error)
+	ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error)
+	ServiceRemove(ctx context.Context, serviceID string) error
+}
+
+// the resolved config travels in the context, rather than being threaded through every helper
+type contextKey string
+
+const configKey contextKey = "composer.config"
+
+const retryBudgetKey contextKey = "composer.retries"
+
+// swarm node ids, as shown by docker node ls
+var nodeIDPattern = regexp.MustCompile(`^[a-z0-9]{25}$`)
+
+var logSizePattern = regexp.MustCompile(`^\d+[kmg]$`)
+
 type config struct {
-	AvoidNetworks map[string]string
-	AvoidMasters  int
-	PnPn          int
+	AvoidNetworks         map[string]string
+	AvoidMasters          int
+	PnPn                  int
+	ContainerLabels       map[string]string
+	TargetStack           string
+	TaskHostname          string
+	LogDriver             string
+	LogDriverOpts         map[string]string
+	StartupRetries        int
+	StartupRetryDelay     time.Duration
+	CycleTime             int
+	PingTargets           []string
+	PreDeployHook         string
+	PostDeployHook        string
+	HookTimeout           time.Duration
+	EventWebhookURL       string
+	Command               []string
+	Mounts                []mount.Mount
+	WorkDir               string
+	ForceNetworks         map[string]string
+	MaxDeployNodes        int
+	ReconcileOnly         bool
+	RedactKeys            map[string]struct{}
+	EnvMap                map[string]string
+	ExtraHosts            []string
+	AttachmentLevel       string
+	StackName             string
+	AttachableOnly        bool
+	NodeFilter            map[string]string
+	ExcludedNodes         []string
+	ReplicaOverrides      map[string]uint64
+	ConnectionTimeout     time.Duration
+	IdleConnectionTimeout time.Duration
+	MaxIdleConns          int
+	MaxConnsPerHost       int
+	ApplyTimeout          time.Duration
+	PlacementConstraints  []string
+	NodeID                string
+	MaxChanges            int
+	Debug                 bool
+	MaxCycleRetries       int
+	Reservations          *swarm.Resources
+	MaxNetworkServices    int
+	CapReplicasByPeers    bool
+	ServiceConfigs        *serviceConfigs
+	CaseInsensitiveNames  bool
+	CreateStagger         time.Duration
+	NetworkSortOrder      string
+	MinNodes              int
+	DockerSock            string
+	Port                  string
+}
+
+// the parts of a service spec that may also be given as json, via SERVICE_CONFIGS_FILE
+type serviceConfigs struct {
+	Mounts    []mount.Mount               `json:"mounts"`
+	Resources *swarm.ResourceRequirements `json:"resources"`
+	Placement *swarm.Placement            `json:"placement"`
+	Labels    map[string]string           `json:"labels"`
+}
+
+func (c *config) debugf(format string, v ...interface{}) {
+	if c.Debug {
+		log.Printf("debug: "+format, v...)
+	}
+}
+
+// WithConfig returns a copy of ctx carrying cfg
+func WithConfig(ctx context.Context, cfg *config) context.Context {
+	return context.WithValue(ctx, configKey, cfg)
+}
+
+// ConfigFromContext returns the config stored by WithConfig, if any
+func ConfigFromContext(ctx context.Context) (*config, bool) {
+	cfg, ok := ctx.Value(configKey).(*config)
+	return cfg, ok && cfg != nil
+}
+
+// how many retries the whole run may still make, shared by every call. nil means no limit
+type retryBudget struct {
+	remaining int32
+}
+
+func (b *retryBudget) take() bool {
+	if b == nil {
+		return true
+	}
+	return atomic.AddInt32(&b.remaining, -1) >= 0
+}
+
+func (b *retryBudget) exhausted() bool {
+	return b != nil && atomic.LoadInt32(&b.remaining) < 0
+}
+
+func withRetryBudget(ctx context.Context, retries int) context.Context {
+	if retries <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, retryBudgetKey, &retryBudget{remaining: int32(retries)})
+}
+
+func getRetryBudget(ctx context.Context) *retryBudget {
+	b, _ := ctx.Value(retryBudgetKey).(*retryBudget)
+	return b
+}
+
+func mustConfig(ctx context.Context) *config {
+	c, ok := ConfigFromContext(ctx)
+	if !ok {
+		panic("no config found in context")
+	}
+	return c
 }
 
 func getKeyValue(data string) (string, string) {
-	bits := strings.Split(data, "=")
+	// only the first = separates the key - values may well contain more of them (label lists, urls etc.)
+	bits := strings.SplitN(data, "=", 2)
 	if len(bits) < 2 {
 		// could be a flag (i.e. a key, with no value)
 		return bits[0], ""
@@ -49,7 +238,8 @@ func getcontainerEnv() env {
 	kvs := make(map[string]kv)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		l := strings.TrimSpace(scanner.Text())
+		// files written on windows end in \r\n - drop any stray \r so it can't end up in a value
+		l := strings.TrimSpace(strings.Replace(scanner.Text(), "\r", "", -1))
 		if !strings.HasPrefix(l, "#") {
 			// not a comment line
 			k, v := getKeyValue(l)
@@ -57,21 +247,79 @@ func getcontainerEnv() env {
 		}
 	}
 
+	if kvs["EXPAND_ENV_VARS"].value == "1" {
+		// opt-in, as existing .env files may well contain literal $ characters
+		for k, v := range kvs {
+			kvs[k] = kv{key: v.key, value: expandValue(v.value)}
+		}
+	}
+
+	secretsDir := kvs["ENV_SECRETS_DIR"].value
+	if secretsDir == "" {
+		// where swarm mounts secrets
+		secretsDir = "/run/secrets"
+	}
+	secrets, err := getSecrets(secretsDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for k, v := range secrets {
+		// secrets win over anything in the .env file
+		kvs[k] = v
+	}
+
 	return kvs
 }
 
-func getConfig(containerEnv env) (config, error) {
+func getSecrets(dir string) (env, error) {
+	// each file in dir is a secret - the file name is the key, its contents the value
+	secrets := make(map[string]kv)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return secrets, nil
+		}
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		secrets[file.Name()] = kv{key: file.Name(), value: strings.TrimRight(string(data), "\r\n")}
+	}
+	return secrets, nil
+}
+
+func expandValue(value string) string {
+	// expands $VAR and ${VAR} from the process environment, the same way docker compose does. $$ is an escaped $
+	return os.Expand(value, func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return os.Getenv(name)
+	})
+}
+
+func getConfig(containerEnv env, noDefaultAvoid bool) (config, error) {
 	cconfig := config{}
+	// ingress is always avoided, on top of anything listed, unless told otherwise
+	cconfig.AvoidNetworks = make(map[string]string)
+	if !noDefaultAvoid {
+		cconfig.AvoidNetworks["ingress"] = "ingress"
+	}
 	avoidStrings := containerEnv["AVOID_NETWORKS"]
 	if avoidStrings.value != "" {
 		nets := getSubStringsMap(avoidStrings.value)
 		if len(nets) == 0 {
 			return cconfig, errors.New("invalid value passed for AVOID_NETWORKS")
 		}
-		cconfig.AvoidNetworks = nets
-	} else {
-		// not specified, so set to default
-		cconfig.AvoidNetworks = map[string]string{"ingress": "ingress"}
+		for k, v := range nets {
+			cconfig.AvoidNetworks[k] = v
+		}
 	}
 
 	avoidMastersString := containerEnv["AVOID_MASTERS"]
@@ -98,214 +346,2363 @@ func getConfig(containerEnv env) (config, error) {
 		cconfig.PnPn = 1
 	}
 
-	return cconfig, nil
-}
+	containerLabels := containerEnv["CONTAINER_LABELS"]
+	if containerLabels.value != "" {
+		labels, err := getKeyValuesMap(containerLabels.value)
+		if err != nil {
+			return cconfig, errors.New("invalid value passed for CONTAINER_LABELS: " + err.Error())
+		}
+		cconfig.ContainerLabels = labels
+	}
 
-func getSubStringsMap(array string) map[string]string {
-	// simple helper that splits string by comma, and returns map
-	result := make(map[string]string)
-	list := strings.Split(array, ",")
-	for _, v := range list {
-		result[v] = v
+	// only consider networks from this stack, if set
+	cconfig.TargetStack = containerEnv["TARGET_STACK"].value
+
+	// passed through as-is, swarm expands the template per task
+	if taskHostname, present := containerEnv["TASK_HOSTNAME"]; present {
+		if strings.TrimSpace(taskHostname.value) == "" {
+			return cconfig, errors.New("invalid value passed for TASK_HOSTNAME: template is empty")
+		}
+		cconfig.TaskHostname = taskHostname.value
 	}
-	return result
-}
 
-func getNetworkList(avoidNetworks map[string]string) []string {
-	cli, err := client.NewClient("unix:///var/run/docker.sock", "", nil, nil)
-	if err != nil {
-		panic(err)
+	// log driver - if not set, the engine default is used
+	cconfig.LogDriver = containerEnv["LOG_DRIVER"].value
+	logDriverOpts := containerEnv["LOG_DRIVER_OPTS"]
+	if logDriverOpts.value != "" {
+		if cconfig.LogDriver == "" {
+			return cconfig, errors.New("LOG_DRIVER_OPTS passed without LOG_DRIVER")
+		}
+		opts, err := getKeyValuesMap(logDriverOpts.value)
+		if err != nil {
+			return cconfig, errors.New("invalid value passed for LOG_DRIVER_OPTS: " + err.Error())
+		}
+		cconfig.LogDriverOpts = opts
+	}
 
+	// rotation is only understood by the file based drivers
+	logMaxSize := containerEnv["LOG_MAX_SIZE"]
+	logMaxFile := containerEnv["LOG_MAX_FILE"]
+	if logMaxSize.value != "" || logMaxFile.value != "" {
+		if cconfig.LogDriver != "json-file" && cconfig.LogDriver != "local" {
+			return cconfig, errors.New("LOG_MAX_SIZE and LOG_MAX_FILE require LOG_DRIVER to be json-file or local")
+		}
+		if cconfig.LogDriverOpts == nil {
+			cconfig.LogDriverOpts = make(map[string]string)
+		}
+		if logMaxSize.value != "" {
+			if !logSizePattern.MatchString(logMaxSize.value) {
+				return cconfig, errors.New("invalid value passed for LOG_MAX_SIZE: " + logMaxSize.value)
+			}
+			cconfig.LogDriverOpts["max-size"] = logMaxSize.value
+		}
+		if logMaxFile.value != "" {
+			s, err := strconv.Atoi(logMaxFile.value)
+			if err != nil || s < 1 {
+				return cconfig, errors.New("invalid value passed for LOG_MAX_FILE: " + logMaxFile.value)
+			}
+			cconfig.LogDriverOpts["max-file"] = logMaxFile.value
+		}
 	}
 
-	ctx := context.Background()
+	startupRetries := containerEnv["STARTUP_RETRIES"]
+	if startupRetries.value != "" {
+		s, err := strconv.Atoi(startupRetries.value)
+		if err != nil {
+			return cconfig, errors.New("invalid value passed for STARTUP_RETRIES: " + err.Error())
+		}
+		cconfig.StartupRetries = s
+	} else {
+		// not specified, so set to default
+		cconfig.StartupRetries = 5
+	}
 
-	list, err := cli.NetworkList(ctx, types.NetworkListOptions{})
-	if err != nil {
-		log.Fatalf("docker api returned an error: %s\n", err.Error())
+	startupRetryDelay := containerEnv["STARTUP_RETRIES_DELAY_SECONDS"]
+	if startupRetryDelay.value != "" {
+		s, err := strconv.Atoi(startupRetryDelay.value)
+		if err != nil {
+			return cconfig, errors.New("invalid value passed for STARTUP_RETRIES_DELAY_SECONDS: " + err.Error())
+		}
+		// anything over an hour is almost certainly a typo, and would look like a hang
+		if s < 0 || s > 3600 {
+			return cconfig, fmt.Errorf("STARTUP_RETRIES_DELAY_SECONDS must be between 0 and 3600, got %d", s)
+		}
+		cconfig.StartupRetryDelay = time.Duration(s) * time.Second
+	} else {
+		// not specified, so set to default
+		cconfig.StartupRetryDelay = 2 * time.Second
 	}
-	networks := []string{}
 
-	for _, network := range list {
-		if network.Driver == "overlay" {
-			// if NOT in list of networks to avoid, add it to our worklist
-			if _, present := avoidNetworks[network.Name]; !present {
-				networks = append(networks, network.Name)
-			}
+	connectionTimeout := containerEnv["CONNECTION_TIMEOUT_SECONDS"]
+	if connectionTimeout.value != "" {
+		s, err := strconv.Atoi(connectionTimeout.value)
+		if err != nil {
+			return cconfig, errors.New("invalid value passed for CONNECTION_TIMEOUT_SECONDS: " + err.Error())
 		}
+		if s < 0 || s > 300 {
+			return cconfig, fmt.Errorf("CONNECTION_TIMEOUT_SECONDS must be between 0 and 300, got %d", s)
+		}
+		cconfig.ConnectionTimeout = time.Duration(s) * time.Second
+	} else {
+		// not specified, so set to default
+		cconfig.ConnectionTimeout = time.Second
 	}
-	return networks
-}
 
-func getNodeList(avoidMasters int) []string {
-	cli, err := client.NewClient("unix:///var/run/docker.sock", "", nil, nil)
-	if err != nil {
-		panic(err)
+	// where to find the daemon
+	cconfig.DockerSock = defaultDockerSocket
+	if dockerSock := containerEnv["DOCKER_SOCK"]; dockerSock.value != "" {
+		if !validDockerSock(dockerSock.value) {
+			return cconfig, errors.New("invalid value passed for DOCKER_SOCK: expected unix://, npipe:// or tcp://, got " + dockerSock.value)
+		}
+		cconfig.DockerSock = dockerSock.value
+	}
 
+	idleConnectionTimeout := containerEnv["IDLE_CONNECTION_TIMEOUT_SECONDS"]
+	if idleConnectionTimeout.value != "" {
+		s, err := strconv.Atoi(idleConnectionTimeout.value)
+		if err != nil {
+			return cconfig, errors.New("invalid value passed for IDLE_CONNECTION_TIMEOUT_SECONDS: " + err.Error())
+		}
+		if s < 0 || s > 3600 {
+			return cconfig, fmt.Errorf("IDLE_CONNECTION_TIMEOUT_SECONDS must be between 0 and 3600, got %d", s)
+		}
+		cconfig.IdleConnectionTimeout = time.Duration(s) * time.Second
+	} else {
+		// not specified, so set to default
+		cconfig.IdleConnectionTimeout = time.Second
 	}
 
-	ctx := context.Background()
+	// connection pool limits for the docker client - 0 leaves the go defaults
+	maxIdleConns := containerEnv["MAX_IDLE_CONNS"]
+	if maxIdleConns.value != "" {
+		s, err := strconv.Atoi(maxIdleConns.value)
+		if err != nil || s < 0 {
+			return cconfig, errors.New("invalid value passed for MAX_IDLE_CONNS: " + maxIdleConns.value)
+		}
+		cconfig.MaxIdleConns = s
+	}
+	maxConnsPerHost := containerEnv["MAX_CONNS_PER_HOST"]
+	if maxConnsPerHost.value != "" {
+		s, err := strconv.Atoi(maxConnsPerHost.value)
+		if err != nil || s < 0 {
+			return cconfig, errors.New("invalid value passed for MAX_CONNS_PER_HOST: " + maxConnsPerHost.value)
+		}
+		cconfig.MaxConnsPerHost = s
+	}
 
-	list, err := cli.NodeList(ctx, types.NodeListOptions{})
-	if err != nil {
-		log.Fatalf("docker api returned an error: %s\n", err.Error())
+	cycleTime := containerEnv["CYCLE_TIME_SECONDS"]
+	if cycleTime.value != "" {
+		s, err := strconv.Atoi(cycleTime.value)
+		if err != nil {
+			return cconfig, errors.New("invalid value passed for CYCLE_TIME_SECONDS: " + err.Error())
+		}
+		cconfig.CycleTime = s
+	} else {
+		// not specified, so set to default
+		cconfig.CycleTime = 30
 	}
-	nodes := []string{}
 
-	for _, node := range list {
-		if node.Spec.Role == "manager" {
-			if avoidMasters == 0 {
-				nodes = append(nodes, node.Description.Hostname)
+	pingTargets := containerEnv["PING_TARGETS"]
+	if pingTargets.value != "" {
+		for _, target := range splitList(pingTargets.value) {
+			target = strings.TrimSpace(target)
+			if target == "" || strings.ContainsAny(target, " \t") {
+				return cconfig, errors.New("invalid value passed for PING_TARGETS: " + pingTargets.value)
 			}
-		} else {
-			nodes = append(nodes, node.Description.Hostname)
+			cconfig.PingTargets = append(cconfig.PingTargets, target)
 		}
+	}
 
+	// shell commands run around each service creation
+	cconfig.PreDeployHook = containerEnv["PRE_DEPLOY_HOOK"].value
+	cconfig.PostDeployHook = containerEnv["POST_DEPLOY_HOOK"].value
+	hookTimeout := containerEnv["HOOK_TIMEOUT_SECONDS"]
+	if hookTimeout.value != "" {
+		s, err := strconv.Atoi(hookTimeout.value)
+		if err != nil || s < 1 {
+			return cconfig, errors.New("invalid value passed for HOOK_TIMEOUT_SECONDS: " + hookTimeout.value)
+		}
+		cconfig.HookTimeout = time.Duration(s) * time.Second
+	} else {
+		// not specified, so set to default
+		cconfig.HookTimeout = 10 * time.Second
 	}
-	return nodes
-}
 
-func setAndGetContainerEnv(containerEnv envs, network string) env {
-	/*
-		main helper that takes the supplied .env file, as would be used by a single stack
-		and transforms it to use the following logic:
+	cconfig.EventWebhookURL = containerEnv["EVENT_WEBHOOK_URL"].value
 
-		1. NEW stackname becomes => stackname + - + network
-		2. NEW entry, "service spec name" is created by => NEW stackname + _ + servicename
-		3. service name stays the same
+	// nil leaves the image's own entrypoint/cmd in charge
+	cconfig.Command = strings.Fields(containerEnv["COMMAND"].value)
+	if len(cconfig.Command) == 0 {
+		cconfig.Command = nil
+	}
 
-		this allows us to scale the same service to multiple networks
-	*/
+	tmpfs := containerEnv["SERVICE_TMPFS"]
+	if tmpfs.value != "" {
+		for _, entry := range splitList(tmpfs.value) {
+			m, err := getTmpfsMount(strings.TrimSpace(entry))
+			if err != nil {
+				return cconfig, errors.New("invalid value passed for SERVICE_TMPFS: " + err.Error())
+			}
+			cconfig.Mounts = append(cconfig.Mounts, m)
+		}
+	}
 
-	// create and load new, deepcopy of env
-	newEnv := make(map[string]kv)
+	volumes := containerEnv["SERVICE_NAMED_VOLUMES"]
+	if volumes.value != "" {
+		for _, entry := range splitList(volumes.value) {
+			m, err := getVolumeMount(strings.TrimSpace(entry))
+			if err != nil {
+				return cconfig, errors.New("invalid value passed for SERVICE_NAMED_VOLUMES: " + err.Error())
+			}
+			cconfig.Mounts = append(cconfig.Mounts, m)
+		}
+	}
 
-	for k, v := range containerEnv[network] {
-		newEnv[k] = v
+	// working directory inside the container - blank keeps the image default
+	workDir := containerEnv["WORKDIR"]
+	if workDir.value != "" {
+		if !path.IsAbs(workDir.value) {
+			return cconfig, errors.New("invalid value passed for WORKDIR, must be an absolute path: " + workDir.value)
+		}
+		cconfig.WorkDir = workDir.value
 	}
 
-	// create new values
-	stackValue := newEnv["STACK_NAME"].value
-	serviceValue := newEnv["SERVICE_NAME"].value
+	// networks to use whatever their driver or stack - the avoid list still applies
+	forceNetworks := containerEnv["FORCE_NETWORKS"]
+	if forceNetworks.value != "" {
+		cconfig.ForceNetworks = getSubStringsMap(forceNetworks.value)
+	}
 
-	stackKey := newEnv["STACK_NAME"].key
+	maxDeployNodes := containerEnv["MAX_DEPLOY_NODES"]
+	if maxDeployNodes.value != "" {
+		s, err := strconv.Atoi(maxDeployNodes.value)
+		if err != nil || s < 1 {
+			return cconfig, errors.New("invalid value passed for MAX_DEPLOY_NODES: " + maxDeployNodes.value)
+		}
+		cconfig.MaxDeployNodes = s
+	}
 
-	newStackName := stackValue + "_" + network
-	newServiceSpecName := newStackName + "_" + serviceValue
-	// replace old stackname entry
-	newEnv["STACK_NAME"] = kv{key: stackKey, value: newStackName}
-	// create new service spec name
-	newEnv["SERVICE_SPEC_NAME"] = kv{key: "SERVICE_SPEC_NAME", value: newServiceSpecName}
+	// never create - only keep the replica count of existing services in line
+	cconfig.ReconcileOnly = containerEnv["RECONCILE_ONLY"].value == "1"
 
-	return newEnv
+	// keys whose values are never printed
+	redactKeys := containerEnv["REDACT_KEYS"]
+	if redactKeys.value != "" {
+		cconfig.RedactKeys = make(map[string]struct{})
+		for k := range getSubStringsMap(redactKeys.value) {
+			cconfig.RedactKeys[k] = struct{}{}
+		}
+	}
 
-}
+	envMapFile := containerEnv["ENV_MAP_FILE"]
+	if envMapFile.value != "" {
+		envMap, err := getEnvMap(envMapFile.value)
+		if err != nil {
+			return cconfig, errors.New("invalid ENV_MAP_FILE: " + err.Error())
+		}
+		cconfig.EnvMap = envMap
+	}
 
-func (containerEnv env) getContainerEnv() []string {
-	var newContainerEnv []string
-	for _, v := range containerEnv {
-		newContainerEnv = append(newContainerEnv, v.key+"="+v.value)
+	serviceConfigsFile := containerEnv["SERVICE_CONFIGS_FILE"]
+	if serviceConfigsFile.value != "" {
+		sc, err := getServiceConfigs(serviceConfigsFile.value)
+		if err != nil {
+			return cconfig, errors.New("invalid SERVICE_CONFIGS_FILE: " + err.Error())
+		}
+		cconfig.ServiceConfigs = sc
 	}
 
-	return newContainerEnv
-}
+	// /etc/hosts entries, given as hostname:ip and handed to swarm as "ip hostname"
+	extraHosts := containerEnv["EXTRA_HOSTS"]
+	if extraHosts.value != "" {
+		for _, entry := range splitList(extraHosts.value) {
+			bits := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+			if len(bits) != 2 || bits[0] == "" || net.ParseIP(bits[1]) == nil {
+				return cconfig, errors.New("invalid value passed for EXTRA_HOSTS, expected hostname:ip, got: " + entry)
+			}
+			cconfig.ExtraHosts = append(cconfig.ExtraHosts, bits[1]+" "+bits[0])
+		}
+	}
 
-func (containerEnv env) getServiceName() string {
-	return containerEnv["SERVICE_NAME"].value
-}
+	// the stack name as given, before any network is added to it
+	cconfig.StackName = containerEnv["STACK_NAME"].value
 
-func (containerEnv env) getServiceSpecName() string {
-	return containerEnv["SERVICE_SPEC_NAME"].value
-}
+	attachableOnly := containerEnv["NETWORK_ATTACHABLE_ONLY"]
+	if attachableOnly.value != "" {
+		b, err := strconv.ParseBool(attachableOnly.value)
+		if err != nil {
+			return cconfig, errors.New("invalid value passed for NETWORK_ATTACHABLE_ONLY: " + err.Error())
+		}
+		cconfig.AttachableOnly = b
+	}
 
-func (containerEnv env) getStackName() string {
-	return containerEnv["STACK_NAME"].value
-}
+	replicaOverrides := containerEnv["REPLICA_OVERRIDES"]
+	if replicaOverrides.value != "" {
+		overrides, err := getKeyValuesMap(replicaOverrides.value)
+		if err != nil {
+			return cconfig, errors.New("invalid value passed for REPLICA_OVERRIDES: " + err.Error())
+		}
+		cconfig.ReplicaOverrides = make(map[string]uint64)
+		for network, count := range overrides {
+			s, err := strconv.ParseUint(count, 10, 64)
+			if err != nil || s == 0 {
+				return cconfig, errors.New("invalid value passed for REPLICA_OVERRIDES, replicas must be a positive integer: " + network + "=" + count)
+			}
+			cconfig.ReplicaOverrides[network] = s
+		}
+	}
 
-func (containerEnv env) getImage() string {
-	return containerEnv["IMAGE"].value
-}
+	// only place tasks on engines carrying these labels (set in the daemon config)
+	engineLabels := containerEnv["ENGINE_LABELS"]
+	if engineLabels.value != "" {
+		labels, err := getKeyValuesMap(engineLabels.value)
+		if err != nil {
+			return cconfig, errors.New("invalid value passed for ENGINE_LABELS: " + err.Error())
+		}
+		keys := []string{}
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		// map order is random, keep the constraints (and so the spec) stable
+		sort.Strings(keys)
+		for _, k := range keys {
+			cconfig.PlacementConstraints = append(cconfig.PlacementConstraints, "engine.labels."+k+"=="+labels[k])
+		}
+	}
 
-func getServiceDefinition(cli *client.Client, replicas uint64, network string, cfg envs) swarm.ServiceSpec {
-	e := setAndGetContainerEnv(cfg, network)
-	// container specs
-	container := swarm.ContainerSpec{Image: e.getImage(), Command: []string{"/go/bin/pinger"}, Env: e.getContainerEnv()}
-	// task specs - replica count
-	reps := swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}}
-	// network to attach to
-	nets := swarm.NetworkAttachmentConfig{Target: network, Aliases: []string{e.getServiceName()}}
-	serviceSpec := swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: container, Networks: []swarm.NetworkAttachmentConfig{nets}}, Mode: reps}
-	serviceSpec.Name = e.getServiceSpecName()
-	serviceSpec.Labels = map[string]string{
-		"com.docker.stack.image":     e.getImage(),
-		"com.docker.stack.namespace": e.getStackName(),
+	// pin every service to one node
+	nodeID := containerEnv["SERVICE_NODE_ID"]
+	if nodeID.value != "" {
+		if !nodeIDPattern.MatchString(nodeID.value) {
+			return cconfig, errors.New("invalid value passed for SERVICE_NODE_ID, expected a 25 character node id: " + nodeID.value)
+		}
+		cconfig.NodeID = nodeID.value
+		cconfig.PlacementConstraints = append(cconfig.PlacementConstraints, "node.id == "+nodeID.value)
 	}
 
-	return serviceSpec
+	maxChanges := containerEnv["MAX_CHANGES_PER_CYCLE"]
+	if maxChanges.value != "" {
+		s, err := strconv.Atoi(maxChanges.value)
+		if err != nil || s < 0 {
+			return cconfig, errors.New("invalid value passed for MAX_CHANGES_PER_CYCLE: " + maxChanges.value)
+		}
+		cconfig.MaxChanges = s
+	}
 
-}
+	cconfig.Debug = containerEnv["DEBUG"].value == "1"
+	cconfig.CapReplicasByPeers = containerEnv["REPLICAS_CAP_BY_PEERS"].value == "1"
+	// network and node names compared ignoring case - for lists typed by hand, or by different tools
+	cconfig.CaseInsensitiveNames = containerEnv["CASE_INSENSITIVE_NAMES"].value == "1"
 
-func main() {
+	// total retries allowed across the whole run - 0 is no limit
+	maxCycleRetries := containerEnv["MAX_CYCLE_RETRIES"]
+	if maxCycleRetries.value != "" {
+		s, err := strconv.Atoi(maxCycleRetries.value)
+		if err != nil || s < 0 {
+			return cconfig, errors.New("invalid value passed for MAX_CYCLE_RETRIES: " + maxCycleRetries.value)
+		}
+		cconfig.MaxCycleRetries = s
+	}
 
-	// get client environment
-	containerEnv := getcontainerEnv()
-	// get config
-	c, err := getConfig(containerEnv)
-	if err != nil {
-		log.Fatalf("startup failed due to a config error: %s", err.Error())
+	// networks with this many services attached already are left alone - 0 is no limit
+	maxNetworkServices := containerEnv["NETWORK_MAX_SERVICES"]
+	if maxNetworkServices.value != "" {
+		s, err := strconv.Atoi(maxNetworkServices.value)
+		if err != nil || s < 0 {
+			return cconfig, errors.New("invalid value passed for NETWORK_MAX_SERVICES: " + maxNetworkServices.value)
+		}
+		cconfig.MaxNetworkServices = s
 	}
 
-	// get network list
-	networks := getNetworkList(c.AvoidNetworks)
-	if len(networks) == 0 {
-		log.Fatalln("no overlay networks found")
+	// pause after each create, so a big worklist doesn't hit the scheduler all at once - 0 is no pause
+	createStagger := containerEnv["CREATE_STAGGER_MS"]
+	if createStagger.value != "" {
+		s, err := strconv.Atoi(createStagger.value)
+		if err != nil || s < 0 {
+			return cconfig, errors.New("invalid value passed for CREATE_STAGGER_MS: " + createStagger.value)
+		}
+		cconfig.CreateStagger = time.Duration(s) * time.Millisecond
 	}
 
-	// get network list
-	nodes := getNodeList(c.AvoidMasters)
-	if len(nodes) <= 1 {
-		if c.PnPn <= 1 {
-			// is pointless deploying a single container into a network on a single node...it will, by definition have NO peers to poll
-			log.Fatalln("no useable nodes found")
+	// resources the scheduler must find free on a node before placing a task there
+	cpuReservation := containerEnv["CPU_RESERVATION"]
+	memoryReservation := containerEnv["MEMORY_RESERVATION"]
+	if cpuReservation.value != "" || memoryReservation.value != "" {
+		cconfig.Reservations = &swarm.Resources{}
+		if cpuReservation.value != "" {
+			// in cores, e.g. 0.25
+			cpus, err := strconv.ParseFloat(cpuReservation.value, 64)
+			if err != nil || cpus <= 0 {
+				return cconfig, errors.New("invalid value passed for CPU_RESERVATION: " + cpuReservation.value)
+			}
+			cconfig.Reservations.NanoCPUs = int64(cpus * 1e9)
+		}
+		if memoryReservation.value != "" {
+			size, err := units.RAMInBytes(memoryReservation.value)
+			if err != nil || size <= 0 {
+				return cconfig, errors.New("invalid value passed for MEMORY_RESERVATION: " + memoryReservation.value)
+			}
+			cconfig.Reservations.MemoryBytes = size
 		}
-	} else {
-		// as we have multiple nodes, ensure PNPN is set to 1
-		c.PnPn = 1
 	}
 
-	// build the workslist
-	worklist := []swarm.ServiceSpec{}
-	cli, err := client.NewClient("unix:///var/run/docker.sock", "", nil, nil)
-	if err != nil {
-		panic(err)
+	// fewer eligible nodes than this and the run is skipped - 0 is no minimum
+	minNodes := containerEnv["MIN_NODES"]
+	if minNodes.value != "" {
+		s, err := strconv.Atoi(minNodes.value)
+		if err != nil || s < 0 {
+			return cconfig, errors.New("invalid value passed for MIN_NODES: " + minNodes.value)
+		}
+		cconfig.MinNodes = s
+	}
 
+	// order the networks are worked through in
+	networkSortOrder := containerEnv["NETWORK_SORT_ORDER"]
+	switch networkSortOrder.value {
+	case "":
+		// not specified, so set to default
+		cconfig.NetworkSortOrder = "name"
+	case "name", "created":
+		cconfig.NetworkSortOrder = networkSortOrder.value
+	default:
+		return cconfig, errors.New("invalid value passed for NETWORK_SORT_ORDER, expected name or created: " + networkSortOrder.value)
 	}
 
-	/*
-		We need to modify the basic container environment for each stack. here we create a structure for handling this
-	*/
-	configs := make(map[string]env)
-	for _, network := range networks {
-		configs[network] = containerEnv
+	// where the network attachment goes in the spec - the service, or each task
+	attachmentLevel := containerEnv["NETWORK_ATTACHMENT_LEVEL"]
+	switch attachmentLevel.value {
+	case "":
+		// not specified, so set to default
+		cconfig.AttachmentLevel = "service"
+	case "service", "task":
+		cconfig.AttachmentLevel = attachmentLevel.value
+	default:
+		return cconfig, errors.New("invalid value passed for NETWORK_ATTACHMENT_LEVEL, expected service or task: " + attachmentLevel.value)
 	}
 
-	/*
-		Create the service config specific for this network
-	*/
-	for _, network := range networks {
+	// handed to the container as it is, checked by portValidator
+	cconfig.Port = strings.TrimSpace(containerEnv["PORT"].value)
+
+	// checks on the finished config - built-in ones first, then anything registered
+	for _, v := range validators {
+		if err := v.Validate(&cconfig); err != nil {
+			return cconfig, err
+		}
+	}
+
+	return cconfig, nil
+}
+
+// ConfigValidator checks a fully parsed config, returning an error if it can't be used
+type ConfigValidator interface {
+	Validate(*config) error
+}
+
+type cycleTimeValidator struct{}
+
+func (cycleTimeValidator) Validate(c *config) error {
+	// anything shorter would have the probes hammering the docker api
+	if c.CycleTime < 5 {
+		return fmt.Errorf("CYCLE_TIME_SECONDS must be at least 5, got %d", c.CycleTime)
+	}
+	return nil
+}
+
+type avoidMastersValidator struct{}
+
+func (avoidMastersValidator) Validate(c *config) error {
+	// used as a switch, so anything else is most likely a typo
+	if c.AvoidMasters != 0 && c.AvoidMasters != 1 {
+		return fmt.Errorf("AVOID_MASTERS must be 0 or 1, got %d", c.AvoidMasters)
+	}
+	return nil
+}
+
+type portValidator struct{}
+
+func (portValidator) Validate(c *config) error {
+	// the port the pinger listens on - optional, but has to be usable if given
+	if c.Port == "" {
+		return nil
+	}
+	port, err := strconv.Atoi(c.Port)
+	if err != nil {
+		return errors.New("invalid value passed for PORT: " + err.Error())
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("PORT must be between 1 and 65535, got %d", port)
+	}
+	return nil
+}
+
+var validators = []ConfigValidator{cycleTimeValidator{}, avoidMastersValidator{}, portValidator{}}
+
+// RegisterValidator adds v to the checks run at the end of getConfig
+func RegisterValidator(v ConfigValidator) {
+	validators = append(validators, v)
+}
+
+func getServiceConfigs(path string) (*serviceConfigs, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sc := &serviceConfigs{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func mergeServiceConfigs(spec *swarm.ServiceSpec, sc *serviceConfigs) {
+	/*
+		fold the json configs into a spec built from the env vars. lists are added to, but where both set
+		the same thing the env var wins, as it is the more specific of the two
+	*/
+	if sc == nil {
+		return
+	}
+	if len(sc.Mounts) > 0 {
+		mounts := make([]mount.Mount, 0, len(spec.TaskTemplate.ContainerSpec.Mounts)+len(sc.Mounts))
+		mounts = append(mounts, spec.TaskTemplate.ContainerSpec.Mounts...)
+		spec.TaskTemplate.ContainerSpec.Mounts = append(mounts, sc.Mounts...)
+	}
+	if sc.Resources != nil {
+		if spec.TaskTemplate.Resources == nil {
+			spec.TaskTemplate.Resources = &swarm.ResourceRequirements{}
+		}
+		if spec.TaskTemplate.Resources.Limits == nil {
+			spec.TaskTemplate.Resources.Limits = sc.Resources.Limits
+		}
+		if spec.TaskTemplate.Resources.Reservations == nil {
+			spec.TaskTemplate.Resources.Reservations = sc.Resources.Reservations
+		}
+	}
+	if sc.Placement != nil && len(sc.Placement.Constraints) > 0 {
+		constraints := []string{}
+		if spec.TaskTemplate.Placement != nil {
+			constraints = append(constraints, spec.TaskTemplate.Placement.Constraints...)
+		}
+		spec.TaskTemplate.Placement = &swarm.Placement{Constraints: append(constraints, sc.Placement.Constraints...)}
+	}
+	for k, v := range sc.Labels {
+		if _, present := spec.Labels[k]; !present {
+			spec.Labels[k] = v
+		}
+	}
+}
+
+func getEnvMap(path string) (map[string]string, error) {
+	// reads "composer_key: container_key" lines - blank lines and # comments are ignored
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	envMap := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		l := strings.TrimSpace(scanner.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		bits := strings.SplitN(l, ":", 2)
+		if len(bits) != 2 || strings.TrimSpace(bits[0]) == "" || strings.TrimSpace(bits[1]) == "" {
+			return nil, fmt.Errorf("line %d: expected key: value, got: %s", line, l)
+		}
+		envMap[strings.TrimSpace(bits[0])] = strings.TrimSpace(bits[1])
+	}
+	return envMap, scanner.Err()
+}
+
+func getVolumeMount(entry string) (mount.Mount, error) {
+	// volumeName:target - the volume is created by docker on first use if it doesn't exist
+	bits := strings.SplitN(entry, ":", 2)
+	if len(bits) != 2 || bits[0] == "" {
+		return mount.Mount{}, errors.New("expected volumeName:targetPath, got: " + entry)
+	}
+	if !strings.HasPrefix(bits[1], "/") {
+		return mount.Mount{}, errors.New("volume target must be an absolute path, got: " + bits[1])
+	}
+	return mount.Mount{Type: mount.TypeVolume, Source: bits[0], Target: bits[1]}, nil
+}
+
+func getTmpfsMount(entry string) (mount.Mount, error) {
+	// target[:size=N][:mode=M] - size as a byte count (suffixes such as 64m are fine), mode in octal
+	parts := strings.Split(entry, ":")
+	if !strings.HasPrefix(parts[0], "/") {
+		return mount.Mount{}, errors.New("tmpfs target must be an absolute path, got: " + parts[0])
+	}
+	m := mount.Mount{Type: mount.TypeTmpfs, Target: parts[0], TmpfsOptions: &mount.TmpfsOptions{}}
+	for _, option := range parts[1:] {
+		k, v := getKeyValue(option)
+		switch k {
+		case "size":
+			size, err := units.RAMInBytes(v)
+			if err != nil || size <= 0 {
+				return mount.Mount{}, errors.New("invalid tmpfs size: " + v)
+			}
+			m.TmpfsOptions.SizeBytes = size
+		case "mode":
+			mode, err := strconv.ParseUint(v, 8, 32)
+			if err != nil {
+				return mount.Mount{}, errors.New("invalid tmpfs mode, expected octal: " + v)
+			}
+			m.TmpfsOptions.Mode = os.FileMode(mode)
+		default:
+			return mount.Mount{}, errors.New("unknown tmpfs option: " + option)
+		}
+	}
+	return m, nil
+}
+
+// ConfigDiff lists the fields that differ between a and b, as "Field: old -> new"
+func ConfigDiff(a, b *config) []string {
+	diffs := []string{}
+	av := reflect.ValueOf(a).Elem()
+	bv := reflect.ValueOf(b).Elem()
+	for i := 0; i < av.NumField(); i++ {
+		af := av.Field(i).Interface()
+		bf := bv.Field(i).Interface()
+		switch av.Field(i).Kind() {
+		case reflect.Map, reflect.Slice, reflect.Struct, reflect.Ptr:
+			if reflect.DeepEqual(af, bf) {
+				continue
+			}
+		default:
+			if af == bf {
+				continue
+			}
+		}
+		diffs = append(diffs, fmt.Sprintf("%s: %v -> %v", av.Type().Field(i).Name, af, bf))
+	}
+	return diffs
+}
+
+func splitList(list string) []string {
+	// splits on commas - a comma escaped as \, is kept, unescaped, as part of the element
+	result := []string{}
+	var current strings.Builder
+	for i := 0; i < len(list); i++ {
+		switch {
+		case list[i] == '\\' && i+1 < len(list) && list[i+1] == ',':
+			current.WriteByte(',')
+			i++
+		case list[i] == ',':
+			result = append(result, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(list[i])
+		}
+	}
+	return append(result, current.String())
+}
+
+func getSubStringsMap(array string) map[string]string {
+	// simple helper that splits string by comma, and returns map
+	result := make(map[string]string)
+	list := splitList(array)
+	for _, v := range list {
+		result[v] = v
+	}
+	return result
+}
+
+func getKeyValuesMap(array string) (map[string]string, error) {
+	// splits a comma-seperated list of key=value pairs, and returns them as a map
+	result := make(map[string]string)
+	for _, pair := range splitList(array) {
+		k, v := getKeyValue(strings.TrimSpace(pair))
+		if k == "" || v == "" {
+			return nil, errors.New("expected key=value, got: " + pair)
+		}
+		result[k] = v
+	}
+	return result, nil
+}
+
+const defaultDockerSocket = "unix:///var/run/docker.sock"
+
+func validDockerSock(sock string) bool {
+	for _, scheme := range []string{"unix://", "npipe://", "tcp://"} {
+		if strings.HasPrefix(sock, scheme) && len(sock) > len(scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+type backoffDialer struct {
+	path    string
+	retries int
+	delay   time.Duration
+	timeout time.Duration
+}
+
+func (d backoffDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	/*
+		the daemon may still be starting when we are (systemd ordering races etc.), so rather than failing
+		on the first refused connection, retry with an exponential back-off
+	*/
+	dialer := net.Dialer{Timeout: d.timeout}
+	delay := d.delay
+	for attempt := 0; ; attempt++ {
+		conn, err := dialer.DialContext(ctx, "unix", d.path)
+		if err == nil {
+			return conn, nil
+		}
+		// a missing socket means the same thing here as a refused connection - the daemon isn't up yet
+		if attempt >= d.retries || !(errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ENOENT)) {
+			return nil, err
+		}
+		log.Printf("docker socket not ready, retrying in %s: %s\n", delay, err.Error())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func getTLSConfig() (*tls.Config, error) {
+	// same variables, and defaults, as the docker cli uses
+	if os.Getenv("DOCKER_TLS_VERIFY") == "" {
+		return nil, nil
+	}
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if certPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		certPath = filepath.Join(home, ".docker")
+	}
+	return tlsconfig.Client(tlsconfig.Options{
+		CAFile:   filepath.Join(certPath, "ca.pem"),
+		CertFile: filepath.Join(certPath, "cert.pem"),
+		KeyFile:  filepath.Join(certPath, "key.pem"),
+	})
+}
+
+func newDockerTransport(ctx context.Context, sock string) (*http.Transport, error) {
+	c := mustConfig(ctx)
+	tlsc, err := getTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		MaxIdleConns:    c.MaxIdleConns,
+		MaxConnsPerHost: c.MaxConnsPerHost,
+		IdleConnTimeout: c.IdleConnectionTimeout,
+	}
+	/*
+		the client switches to https as soon as the transport carries a tls config, which only a tcp daemon
+		speaks - so refuse it for the local sockets rather than have every call fail
+	*/
+	if tlsc != nil && !strings.HasPrefix(sock, "tcp://") {
+		return nil, errors.New("DOCKER_TLS_VERIFY is only supported with a tcp:// DOCKER_SOCK, got: " + sock)
+	}
+	switch {
+	case strings.HasPrefix(sock, "tcp://"):
+		// remote daemon - a plain dialer, with our timeout
+		transport.TLSClientConfig = tlsc
+		transport.DialContext = (&net.Dialer{Timeout: c.ConnectionTimeout}).DialContext
+	case strings.HasPrefix(sock, "unix://"):
+		path := strings.TrimPrefix(sock, "unix://")
+		if err := checkSocketAccess(path); err != nil {
+			return nil, err
+		}
+		dialer := backoffDialer{path: path, retries: c.StartupRetries, delay: c.StartupRetryDelay, timeout: c.ConnectionTimeout}
+		transport.DialContext = dialer.DialContext
+	case strings.HasPrefix(sock, "npipe://"):
+		// named pipes only exist on windows, so leave the dialing to the docker libs
+		if err := sockets.ConfigureTransport(transport, "npipe", strings.TrimPrefix(sock, "npipe://")); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("invalid value passed for DOCKER_SOCK: " + sock)
+	}
+	return transport, nil
+}
+
+func newDockerClient(ctx context.Context) (*client.Client, error) {
+	sock := mustConfig(ctx).DockerSock
+	transport, err := newDockerTransport(ctx, sock)
+	if err != nil {
+		return nil, err
+	}
+	return newAPIClient(sock, transport)
+}
+
+func newAPIClient(sock string, transport *http.Transport) (*client.Client, error) {
+	httpClient := &http.Client{Transport: transport}
+	cli, err := client.NewClient(sock, "", httpClient, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the client insists on an *http.Transport up front, to check for tls, but only uses it as a RoundTripper after
+	httpClient.Transport = statusTransport{transport}
+	return cli, nil
+}
+
+// statusTransport turns the responses worth retrying into a retryableError while the status code is still
+// known - the client only passes on the daemon's message, never the code
+type statusTransport struct {
+	*http.Transport
+}
+
+func (t statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.Transport.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return resp, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	// same message the client would have built from the body
+	message := strings.TrimSpace(string(body))
+	var errorResponse types.ErrorResponse
+	if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Message != "" {
+		message = errorResponse.Message
+	}
+	if message == "" {
+		message = http.StatusText(resp.StatusCode)
+	}
+	return nil, retryableError{status: resp.StatusCode, err: errors.New("Error response from daemon: " + message)}
+}
+
+// how many network entries are worked through at a time
+const networkPageSize = 500
+
+func paginateNetworks(ctx context.Context, cli dockerAPI, pageSize int) ([]targetNetwork, error) {
+	/*
+		the api has no paging, so the whole list is decoded into memory before we see any of it - working
+		through it in pages does not lower that peak. what it does do is keep the filtering to pageSize entries
+		at a time, and each entry is cleared once looked at, so its bulky parts (containers, options, ipam) can
+		be collected during the rest of the run rather than living as long as the list does.
+		BenchmarkPaginateNetworks has the numbers for 10,000 networks
+	*/
+	c := mustConfig(ctx)
+
+	list, err := cli.NetworkList(ctx, types.NetworkListOptions{Filters: getNetworkFilters(c)})
+	if err != nil {
+		return nil, err
+	}
+	networks := []targetNetwork{}
+
+	var serviceCounts map[string]int
+	if c.MaxNetworkServices > 0 {
+		serviceCounts, err = countOtherServices(ctx, cli)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for start := 0; start < len(list); start += pageSize {
+		end := start + pageSize
+		if end > len(list) {
+			end = len(list)
+		}
+		for i := start; i < end; i++ {
+			network := list[i]
+			list[i] = types.NetworkResource{}
+			reason := getSkipReason(network, c)
+			if reason == "" && c.MaxNetworkServices > 0 && serviceCounts[network.ID] >= c.MaxNetworkServices {
+				reason = "full"
+			}
+			if reason != "" {
+				c.debugf("skipping network %s (%s): %s\n", network.Name, shortID(network.ID), reason)
+				continue
+			}
+			networks = append(networks, targetNetwork{id: network.ID, name: network.Name, key: network.Name, created: network.Created})
+		}
+	}
+	return networks, nil
+}
+
+func countNetworkServices(ctx context.Context, cli dockerAPI) (map[string]int, error) {
+	// how many services are attached to each network id. the network list api doesn't say, so ask the services
+	services, err := cli.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return countAttachments(services, ""), nil
+}
+
+func countOtherServices(ctx context.Context, cli dockerAPI) (map[string]int, error) {
+	/*
+		as countNetworkServices, but our own don't count - for NETWORK_MAX_SERVICES, where a network would otherwise
+		fill up with the service we put there, and be dropped
+	*/
+	services, err := cli.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return countAttachments(services, mustConfig(ctx).StackName), nil
+}
+
+func countAttachments(services []swarm.Service, skipStack string) map[string]int {
+	// services attached to each network id, leaving out those from skipStack if it is set
+	counts := make(map[string]int)
+	for _, service := range services {
+		if skipStack != "" && service.Spec.Labels[stackLabel] == skipStack {
+			continue
+		}
+		attachments := append(service.Spec.Networks, service.Spec.TaskTemplate.Networks...)
+		seen := make(map[string]struct{})
+		for _, attachment := range attachments {
+			if _, done := seen[attachment.Target]; done {
+				continue
+			}
+			seen[attachment.Target] = struct{}{}
+			counts[attachment.Target]++
+		}
+	}
+	return counts
+}
+
+func getPeerNodeCount(ctx context.Context, cli dockerAPI, network string) (int, error) {
+	// the nodes this overlay network currently spans, as seen by the node we're talking to
+	resource, err := cli.NetworkInspect(ctx, network)
+	if err != nil {
+		return 0, err
+	}
+	return len(resource.Peers), nil
+}
+
+func getSkipReason(network types.NetworkResource, c *config) string {
+	// why network is not used - or blank if it is
+	forced := hasName(c.ForceNetworks, network.Name, c.CaseInsensitiveNames)
+	if network.Driver != "overlay" && !forced {
+		return "driver"
+	}
+	if c.TargetStack != "" && !sameName(network.Labels["com.docker.stack.namespace"], c.TargetStack, c.CaseInsensitiveNames) && !forced {
+		// belongs to some other stack
+		return "not-included"
+	}
+	if c.AttachableOnly && !network.Attachable {
+		return "not-attachable"
+	}
+	if isAvoided(network, c.AvoidNetworks, c.CaseInsensitiveNames) {
+		return "avoid"
+	}
+	return ""
+}
+
+func getNetworkList(ctx context.Context, cli dockerAPI) []targetNetwork {
+	networks, err := paginateNetworks(ctx, cli, networkPageSize)
+	if err != nil {
+		log.Fatalf("docker api returned an error: %s\n", err.Error())
+	}
+
+	// the api gives no ordering guarantee - sort, so the worklist comes out the same from run to run
+	c := mustConfig(ctx)
+	sort.SliceStable(networks, func(i, j int) bool {
+		if c.NetworkSortOrder == "created" && !networks[i].created.Equal(networks[j].created) {
+			return networks[i].created.Before(networks[j].created)
+		}
+		if networks[i].name != networks[j].name {
+			return networks[i].name < networks[j].name
+		}
+		return networks[i].id < networks[j].id
+	})
+
+	names := make(map[string]int)
+	for _, network := range networks {
+		names[network.name]++
+	}
+
+	selected := []string{}
+	for _, network := range networks {
+		selected = append(selected, network.name)
+	}
+	log.Printf("using networks: %s\n", strings.Join(selected, ", "))
+
+	// names are only unique per scope, so two networks can share one - the id is used to tell them apart
+	for i, network := range networks {
+		if names[network.name] > 1 {
+			log.Printf("warning: more than one overlay network named %s found\n", network.name)
+			networks[i].key = network.name + "_" + shortID(network.id)
+		}
+	}
+	return networks
+}
+
+/*
+	filter builders for the docker list calls - these let the engine do the filtering rather than sending us
+	everything. the results are still checked client side, as older engines ignore filters they don't know
+*/
+
+func getNetworkFilters(c *config) filters.Args {
+	args := filters.NewArgs()
+	if len(c.ForceNetworks) > 0 {
+		// forced networks can be of any driver and stack, so we need to see everything
+		return args
+	}
+	args.Add("driver", "overlay")
+	if c.TargetStack != "" && !c.CaseInsensitiveNames {
+		// label filters are exact, so when ignoring case this is left to getSkipReason
+		args.Add("label", "com.docker.stack.namespace="+c.TargetStack)
+	}
+	return args
+}
+
+func getNodeName(nodes map[string]string, name string) string {
+	// the hostname as swarm has it, for a name that may differ in case
+	if _, present := nodes[name]; present {
+		return name
+	}
+	for node := range nodes {
+		if strings.EqualFold(node, name) {
+			return node
+		}
+	}
+	return name
+}
+
+func getReplicaOverride(c *config, network string) (uint64, bool) {
+	// REPLICA_OVERRIDES entry for the network - an exact match first, then one differing in case if names are folded
+	if replicas, present := c.ReplicaOverrides[network]; present {
+		return replicas, true
+	}
+	if c.CaseInsensitiveNames {
+		for name, replicas := range c.ReplicaOverrides {
+			if strings.EqualFold(name, network) {
+				return replicas, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func getServiceFilters(labels map[string]string) filters.Args {
+	args := filters.NewArgs()
+	for k, v := range labels {
+		args.Add("label", k+"="+v)
+	}
+	return args
+}
+
+func isAvoided(network types.NetworkResource, avoidNetworks map[string]string, fold bool) bool {
+	// entries may be given as a name, or as an id (full, or short as shown by docker network ls)
+	for _, key := range []string{network.Name, network.ID, shortID(network.ID)} {
+		if hasName(avoidNetworks, key, fold) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameName(a, b string, fold bool) bool {
+	if fold {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+func hasName(names map[string]string, name string, fold bool) bool {
+	if _, present := names[name]; present {
+		return true
+	}
+	if fold {
+		for k := range names {
+			if strings.EqualFold(k, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// why nodes were left out by getNodeList - so an empty list can be explained
+type nodeBreakdown struct {
+	total            int
+	excludedManagers int
+	drained          int
+	filtered         int
+	// ids of the nodes services must be kept off, as the node filter or MAX_DEPLOY_NODES left them out
+	excluded []string
+}
+
+func (b nodeBreakdown) String() string {
+	return fmt.Sprintf("%d nodes: %d managers excluded by AVOID_MASTERS, %d drained, %d not in the node filter", b.total, b.excludedManagers, b.drained, b.filtered)
+}
+
+func getNodeList(ctx context.Context, cli dockerAPI) ([]string, nodeBreakdown) {
+	/*
+		managers are fetched too (rather than filtered out by the engine) so that they can be counted when
+		explaining why nothing is left
+	*/
+	c := mustConfig(ctx)
+
+	list, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		log.Fatalf("docker api returned an error: %s\n", err.Error())
+	}
+	nodes := []string{}
+	breakdown := nodeBreakdown{total: len(list)}
+	restricted := false
+
+	for _, node := range list {
+		if node.Spec.Role == swarm.NodeRoleManager && c.AvoidMasters != 0 {
+			breakdown.excludedManagers++
+			continue
+		}
+		if node.Spec.Availability == swarm.NodeAvailabilityDrain {
+			// nothing will be scheduled there
+			breakdown.drained++
+			continue
+		}
+		nodes = append(nodes, node.Description.Hostname)
+	}
+
+	if len(c.NodeFilter) > 0 {
+		// only the named nodes - and only if they survived the filtering above
+		eligible := make(map[string]string)
+		for _, node := range nodes {
+			eligible[node] = node
+		}
+		before := len(nodes)
+		nodes = []string{}
+		for name := range c.NodeFilter {
+			if hasName(eligible, name, c.CaseInsensitiveNames) {
+				nodes = append(nodes, getNodeName(eligible, name))
+			} else {
+				log.Printf("warning: node %s from --node-filter not found, or not eligible\n", name)
+			}
+		}
+		sort.Strings(nodes)
+		breakdown.filtered = before - len(nodes)
+		restricted = true
+	}
+
+	if c.MaxDeployNodes > 0 && len(nodes) > c.MaxDeployNodes {
+		// canary - sorted first, so the same nodes are picked every time
+		sort.Strings(nodes)
+		log.Printf("warning: MAX_DEPLOY_NODES is %d, excluding %d of %d nodes\n", c.MaxDeployNodes, len(nodes)-c.MaxDeployNodes, len(nodes))
+		nodes = nodes[:c.MaxDeployNodes]
+		restricted = true
+	}
+	if restricted {
+		/*
+			left alone, the scheduler would place tasks on any node - so every node that was not picked
+			(managers and drained ones included) is excluded by id, through placement constraints
+		*/
+		picked := make(map[string]bool)
+		for _, node := range nodes {
+			picked[node] = true
+		}
+		for _, node := range list {
+			if !picked[node.Description.Hostname] {
+				breakdown.excluded = append(breakdown.excluded, node.ID)
+			}
+		}
+	}
+	return nodes, breakdown
+}
+
+func setAndGetContainerEnv(containerEnv envs, network targetNetwork) env {
+	/*
+		main helper that takes the supplied .env file, as would be used by a single stack
+		and transforms it to use the following logic:
+
+		1. NEW stackname becomes => stackname + - + network
+		2. NEW entry, "service spec name" is created by => NEW stackname + _ + servicename
+		3. service name stays the same
+
+		this allows us to scale the same service to multiple networks
+	*/
+
+	// create and load new, deepcopy of env
+	newEnv := make(map[string]kv)
+
+	for k, v := range containerEnv[network.id] {
+		newEnv[k] = v
+	}
+
+	// create new values
+	stackValue := newEnv["STACK_NAME"].value
+	serviceValue := newEnv["SERVICE_NAME"].value
+
+	stackKey := newEnv["STACK_NAME"].key
+
+	newStackName := generateNetworkName(stackValue, network.key)
+	// the stack name is only the prefix, so leave room for the service name within docker's limit
+	if room := maxServiceNameLength - len(serviceValue) - 1; room > 0 && len(newStackName) > room {
+		newStackName = strings.TrimRight(newStackName[:room], "_-")
+	}
+	newServiceSpecName := newStackName + "_" + serviceValue
+	// replace old stackname entry
+	newEnv["STACK_NAME"] = kv{key: stackKey, value: newStackName}
+	// create new service spec name
+	newEnv["SERVICE_SPEC_NAME"] = kv{key: "SERVICE_SPEC_NAME", value: newServiceSpecName}
+
+	return newEnv
+
+}
+
+// swarm rejects service names longer than this
+const maxServiceNameLength = 63
+
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+func generateNetworkName(base, suffix string) string {
+	/*
+		joins base and suffix with an _ and makes the result usable within a service name, which is what it
+		ends up as: only [A-Za-z0-9_-] (no dots), case left alone, no leading or trailing - or _, and no
+		more than 63 characters
+	*/
+	name := strings.TrimSpace(base)
+	if suffix = strings.TrimSpace(suffix); suffix != "" {
+		name += "_" + suffix
+	}
+	name = invalidNameChars.ReplaceAllString(name, "-")
+	name = strings.Trim(name, "_-")
+	if len(name) > maxServiceNameLength {
+		name = strings.TrimRight(name[:maxServiceNameLength], "_-")
+	}
+	return name
+}
+
+func (containerEnv env) getContainerEnv(envMap map[string]string) []string {
+	// keys found in envMap are renamed on the way into the container, the rest pass through as they are
+	var newContainerEnv []string
+	for _, v := range containerEnv {
+		key := v.key
+		if mapped, present := envMap[key]; present {
+			key = mapped
+		}
+		newContainerEnv = append(newContainerEnv, key+"="+v.value)
+	}
+	// keep the order stable, so the same config always gives the same spec
+	sort.Strings(newContainerEnv)
+
+	return newContainerEnv
+}
+
+// Redacted returns a copy of the env with the values of redactKeys replaced
+func (containerEnv env) Redacted(redactKeys map[string]struct{}) env {
+	redacted := make(map[string]kv)
+	for k, v := range containerEnv {
+		if _, present := redactKeys[k]; present {
+			v.value = "[REDACTED]"
+		}
+		redacted[k] = v
+	}
+	return redacted
+}
+
+// Diff compares the env with other, returning the keys only other has, those only this env has, and those in
+// both with different values - each sorted
+func (containerEnv env) Diff(other env) (added, removed, changed []string) {
+	for k, v := range other {
+		current, present := containerEnv[k]
+		if !present {
+			added = append(added, k)
+		} else if current.value != v.value {
+			changed = append(changed, k)
+		}
+	}
+	for k := range containerEnv {
+		if _, present := other[k]; !present {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+func (containerEnv env) getServiceName() string {
+	return containerEnv["SERVICE_NAME"].value
+}
+
+func (containerEnv env) getServiceSpecName() string {
+	return containerEnv["SERVICE_SPEC_NAME"].value
+}
+
+func (containerEnv env) getStackName() string {
+	return containerEnv["STACK_NAME"].value
+}
+
+func (containerEnv env) getImage() string {
+	return containerEnv["IMAGE"].value
+}
+
+func getContainerLabels(c config) map[string]string {
+	// container labels are kept apart from the service labels - some log routers (fluentd etc.) only look at these
+	if len(c.ContainerLabels) == 0 {
+		return nil
+	}
+	labels := make(map[string]string)
+	for k, v := range c.ContainerLabels {
+		labels[k] = v
+	}
+	return labels
+}
+
+func getLogDriver(c config) *swarm.Driver {
+	if c.LogDriver == "" {
+		return nil
+	}
+	return &swarm.Driver{Name: c.LogDriver, Options: c.LogDriverOpts}
+}
+
+const specHashLabel = "com.nicgrobler.composer.spec-hash"
+
+// every service we create carries the STACK_NAME it was created from. the stack namespace label can't be used to
+// find them, as that has the network name added to it
+const stackLabel = "com.nicgrobler.composer.stack"
+
+// ServiceListFilter returns the services composer created for the stack namespace
+func ServiceListFilter(ctx context.Context, cli dockerAPI, namespace string) ([]swarm.Service, error) {
+	return cli.ServiceList(ctx, types.ServiceListOptions{Filters: getServiceFilters(map[string]string{stackLabel: namespace})})
+}
+
+func hashSpec(spec swarm.ServiceSpec, skipLabels ...string) (string, error) {
+	// sha256 of the spec as json (maps marshal in key order, so this is stable), leaving out skipLabels
+	labels := make(map[string]string)
+	for k, v := range spec.Labels {
+		labels[k] = v
+	}
+	for _, k := range skipLabels {
+		delete(labels, k)
+	}
+	spec.Labels = labels
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func getSpecHash(spec swarm.ServiceSpec) (string, error) {
+	/*
+		hash of everything we put in the spec, bar our own labels. comparing this against the label on a
+		running service tells us whether our desired spec has changed, without tripping over fields swarm fills in
+	*/
+	return hashSpec(spec, specHashLabel, fingerprintLabel)
+}
+
+const fingerprintLabel = "composer.fingerprint"
+
+// the parts of a spec composer sets, in a form the daemon leaves alone - see composerFingerprint
+type managedFields struct {
+	Name        string
+	Labels      map[string]string
+	Image       string
+	Command     []string
+	Env         []string
+	Container   map[string]string
+	Hostname    string
+	Dir         string
+	Hosts       []string
+	Mounts      []string
+	Replicas    uint64
+	Networks    []string
+	Constraints []string
+	Resources   *swarm.ResourceRequirements
+	LogDriver   *swarm.Driver
+}
+
+func getManagedFields(spec swarm.ServiceSpec) managedFields {
+	/*
+		the daemon fills in defaults (update config, endpoint mode etc.), pins the image to a digest and may
+		move service level networks onto the task - none of which is a change made to the service. so only pick
+		out what we set, and undo those rewrites
+	*/
+	container := spec.TaskTemplate.ContainerSpec
+	fields := managedFields{
+		Name:      spec.Name,
+		Labels:    make(map[string]string),
+		Image:     strings.SplitN(container.Image, "@", 2)[0],
+		Command:   container.Command,
+		Env:       append([]string{}, container.Env...),
+		Container: container.Labels,
+		Hostname:  container.Hostname,
+		Dir:       container.Dir,
+		Hosts:     container.Hosts,
+		Mounts:    []string{},
+		Networks:  []string{},
+		LogDriver: spec.TaskTemplate.LogDriver,
+	}
+	for k, v := range spec.Labels {
+		if k != specHashLabel && k != fingerprintLabel {
+			fields.Labels[k] = v
+		}
+	}
+	sort.Strings(fields.Env)
+	for _, m := range container.Mounts {
+		entry := fmt.Sprintf("%s:%s:%s:%v", m.Type, m.Source, m.Target, m.ReadOnly)
+		if m.TmpfsOptions != nil {
+			entry += fmt.Sprintf(":%d", m.TmpfsOptions.SizeBytes)
+		}
+		fields.Mounts = append(fields.Mounts, entry)
+	}
+	if spec.Mode.Replicated != nil && spec.Mode.Replicated.Replicas != nil {
+		fields.Replicas = *spec.Mode.Replicated.Replicas
+	}
+	for _, network := range append(append([]swarm.NetworkAttachmentConfig{}, spec.Networks...), spec.TaskTemplate.Networks...) {
+		fields.Networks = append(fields.Networks, network.Target)
+	}
+	sort.Strings(fields.Networks)
+	if spec.TaskTemplate.Placement != nil {
+		fields.Constraints = spec.TaskTemplate.Placement.Constraints
+	}
+	if r := spec.TaskTemplate.Resources; r != nil && (r.Limits != nil || r.Reservations != nil) {
+		fields.Resources = r
+	}
+	return fields
+}
+
+func composerFingerprint(spec swarm.ServiceSpec) string {
+	/*
+		hash of the fields composer manages, as we deployed them. if a running service no longer matches its
+		fingerprint label, someone changed it outside of composer
+	*/
+	b, err := json.Marshal(getManagedFields(spec))
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func getServiceDefinition(ctx context.Context, replicas uint64, network targetNetwork, cfg envs) (swarm.ServiceSpec, error) {
+	c, ok := ConfigFromContext(ctx)
+	if !ok {
+		return swarm.ServiceSpec{}, errors.New("no config found in context")
+	}
+	e := setAndGetContainerEnv(cfg, network)
+	if e.getImage() == "" {
+		return swarm.ServiceSpec{}, errors.New("no IMAGE set")
+	}
+	if e.getServiceName() == "" {
+		return swarm.ServiceSpec{}, errors.New("no SERVICE_NAME set")
+	}
+	if len(c.PingTargets) > 0 {
+		// hand the cleaned up list to the pinger
+		e["PING_TARGETS"] = kv{key: "PING_TARGETS", value: strings.Join(c.PingTargets, ",")}
+	}
+	// container specs
+	container := swarm.ContainerSpec{Image: e.getImage(), Command: c.Command, Env: e.getContainerEnv(c.EnvMap), Labels: getContainerLabels(*c), Hostname: c.TaskHostname, Mounts: c.Mounts, Dir: c.WorkDir, Hosts: c.ExtraHosts}
+	// task specs - replica count
+	reps := swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}}
+	// network to attach to
+	nets := swarm.NetworkAttachmentConfig{Target: network.id, Aliases: []string{e.getServiceName()}}
+	serviceSpec := swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: container, LogDriver: getLogDriver(*c)}, Mode: reps}
+	// copied, so that the node exclusions never end up in the config's own slice
+	constraints := append([]string{}, c.PlacementConstraints...)
+	for _, id := range c.ExcludedNodes {
+		constraints = append(constraints, "node.id != "+id)
+	}
+	if len(constraints) > 0 {
+		serviceSpec.TaskTemplate.Placement = &swarm.Placement{Constraints: constraints}
+	}
+	if c.Reservations != nil {
+		serviceSpec.TaskTemplate.Resources = &swarm.ResourceRequirements{Reservations: c.Reservations}
+	}
+	if c.AttachmentLevel == "task" {
+		serviceSpec.TaskTemplate.Networks = []swarm.NetworkAttachmentConfig{nets}
+	} else {
+		serviceSpec.Networks = []swarm.NetworkAttachmentConfig{nets}
+	}
+	serviceSpec.Name = e.getServiceSpecName()
+	serviceSpec.Labels = map[string]string{
+		"com.docker.stack.image":     e.getImage(),
+		"com.docker.stack.namespace": e.getStackName(),
+		stackLabel:                   c.StackName,
+	}
+	mergeServiceConfigs(&serviceSpec, c.ServiceConfigs)
+	hash, err := getSpecHash(serviceSpec)
+	if err != nil {
+		return swarm.ServiceSpec{}, err
+	}
+	serviceSpec.Labels[specHashLabel] = hash
+	serviceSpec.Labels[fingerprintLabel] = composerFingerprint(serviceSpec)
+
+	return serviceSpec, nil
+
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToUpper(key)
+	return strings.Contains(key, "TOKEN") || strings.Contains(key, "SECRET") || strings.Contains(key, "PASSWORD")
+}
+
+// the config fields taken from each .env key, so that redacting the key covers what was parsed from it too
+var configFields = map[string][]string{
+	"AVOID_NETWORKS":        {"AvoidNetworks"},
+	"COMMAND":               {"Command"},
+	"CONTAINER_LABELS":      {"ContainerLabels"},
+	"DOCKER_SOCK":           {"DockerSock"},
+	"ENGINE_LABELS":         {"PlacementConstraints"},
+	"ENV_MAP_FILE":          {"EnvMap"},
+	"EVENT_WEBHOOK_URL":     {"EventWebhookURL"},
+	"EXTRA_HOSTS":           {"ExtraHosts"},
+	"FORCE_NETWORKS":        {"ForceNetworks"},
+	"LOG_DRIVER":            {"LogDriver"},
+	"LOG_DRIVER_OPTS":       {"LogDriverOpts"},
+	"PING_TARGETS":          {"PingTargets"},
+	"POST_DEPLOY_HOOK":      {"PostDeployHook"},
+	"PRE_DEPLOY_HOOK":       {"PreDeployHook"},
+	"REPLICA_OVERRIDES":     {"ReplicaOverrides"},
+	"SERVICE_CONFIGS_FILE":  {"ServiceConfigs"},
+	"SERVICE_NAMED_VOLUMES": {"Mounts"},
+	"SERVICE_NODE_ID":       {"NodeID"},
+	"SERVICE_TMPFS":         {"Mounts"},
+	"STACK_NAME":            {"StackName"},
+	"TARGET_STACK":          {"TargetStack"},
+	"TASK_HOSTNAME":         {"TaskHostname"},
+	"WORKDIR":               {"WorkDir"},
+}
+
+func dumpConfig(w io.Writer, c config, containerEnv env) error {
+	/*
+		diagnostic helper that writes the resolved config, including any defaults, and the parsed .env as json.
+		anything that looks like a secret is redacted, as is anything given in REDACT_KEYS - in both sections
+	*/
+	resolved := make(map[string]interface{})
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &resolved); err != nil {
+		return err
+	}
+	for k := range resolved {
+		if isSensitive(k) {
+			resolved[k] = "[REDACTED]"
+		}
+	}
+	for k := range c.RedactKeys {
+		for _, field := range configFields[k] {
+			if _, present := resolved[field]; present {
+				resolved[field] = "[REDACTED]"
+			}
+		}
+	}
+
+	environment := make(map[string]string)
+	for k, v := range containerEnv.Redacted(c.RedactKeys) {
+		if isSensitive(k) {
+			environment[k] = "[REDACTED]"
+		} else {
+			environment[k] = v.value
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]interface{}{"config": resolved, "env": environment})
+}
+
+func getNetworkNames(networks []targetNetwork) map[string]string {
+	names := make(map[string]string)
+	for _, network := range networks {
+		names[network.id] = network.name
+	}
+	return names
+}
+
+func getTargetNetwork(spec swarm.ServiceSpec) string {
+	// the id of the network the service attaches to, at whichever level it was attached
+	if len(spec.Networks) > 0 {
+		return spec.Networks[0].Target
+	}
+	if len(spec.TaskTemplate.Networks) > 0 {
+		return spec.TaskTemplate.Networks[0].Target
+	}
+	return ""
+}
+
+// NetworkStatus is what --network-status shows for each network
+type NetworkStatus struct {
+	Name         string
+	Driver       string
+	Subnet       string
+	Peers        int
+	ServiceCount int
+	Attachable   bool
+}
+
+// GetNetworkStatus inspects the network name (or id), and counts every service attached to it
+func GetNetworkStatus(ctx context.Context, cli dockerAPI, name string) (NetworkStatus, error) {
+	counts, err := countNetworkServices(ctx, cli)
+	if err != nil {
+		return NetworkStatus{}, err
+	}
+	return getNetworkStatus(ctx, cli, name, counts)
+}
+
+func getNetworkStatus(ctx context.Context, cli dockerAPI, name string, counts map[string]int) (NetworkStatus, error) {
+	// counts is from countNetworkServices - taken once, rather than listing every service for every network
+	resource, err := cli.NetworkInspect(ctx, name)
+	if err != nil {
+		return NetworkStatus{}, err
+	}
+	status := NetworkStatus{
+		Name:         resource.Name,
+		Driver:       resource.Driver,
+		Peers:        len(resource.Peers),
+		ServiceCount: counts[resource.ID],
+		Attachable:   resource.Attachable,
+	}
+	if len(resource.IPAM.Config) > 0 {
+		status.Subnet = resource.IPAM.Config[0].Subnet
+	}
+	return status, nil
+}
+
+func printNetworkStatus(ctx context.Context, cli dockerAPI, w io.Writer, networks []targetNetwork) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	counts, err := countNetworkServices(ctx, cli)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(tw, "NAME\tDRIVER\tSUBNET\tPEERS\tSERVICES\tATTACHABLE")
+	for _, network := range networks {
+		status, err := getNetworkStatus(ctx, cli, network.id, counts)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%t\n", status.Name, status.Driver, status.Subnet, status.Peers, status.ServiceCount, status.Attachable)
+	}
+	return tw.Flush()
+}
+
+func printServiceList(w io.Writer, worklist []swarm.ServiceSpec, networks []targetNetwork) error {
+	/*
+		one service per line: name, network, image. the columns are padded out with spaces (tabwriter never
+		truncates), and nothing follows the image, so lines have no trailing spaces - split on whitespace, with awk
+		or read, rather than on tabs with cut
+	*/
+	names := getNetworkNames(networks)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, work := range worklist {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", work.Name, names[getTargetNetwork(work)], work.TaskTemplate.ContainerSpec.Image)
+	}
+	return tw.Flush()
+}
+
+func runHook(ctx context.Context, command string, serviceName string, network string) error {
+	// a hook that hangs is killed after HOOK_TIMEOUT_SECONDS, or sooner if the service's own time is up
+	if command == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, mustConfig(ctx).HookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "SERVICE_NAME="+serviceName, "NETWORK="+network)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("hook %q timed out: %v", command, ctx.Err())
+		}
+		return fmt.Errorf("hook %q failed: %v", command, err)
+	}
+	return nil
+}
+
+// an api error that is worth trying again - the daemon is busy or briefly unavailable, rather than refusing the request
+type retryableError struct {
+	status int
+	err    error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryableError) Unwrap() error {
+	return e.err
+}
+
+func classifyError(err error) error {
+	/*
+		statusTransport has already picked out the 429s and 503s by their status code - unwrap those from the
+		client's "error during connect" decoration. anything else (image not found, bad spec etc.) is not retryable
+	*/
+	var retryable retryableError
+	if errors.As(err, &retryable) {
+		return retryable
+	}
+	return err
+}
+
+func isRetryable(err error) bool {
+	var retryable retryableError
+	return errors.As(err, &retryable) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func createService(ctx context.Context, cli dockerAPI, spec swarm.ServiceSpec) error {
+	// creates the service, retrying transient failures with the same back-off as the startup dial
+	c := mustConfig(ctx)
+	delay := c.StartupRetryDelay
+	for attempt := 0; ; attempt++ {
+		_, err := cli.ServiceCreate(ctx, spec, types.ServiceCreateOptions{})
+		err = classifyError(err)
+		if err == nil || !isRetryable(err) || attempt >= c.StartupRetries {
+			return err
+		}
+		if !getRetryBudget(ctx).take() {
+			return fmt.Errorf("retry budget for this run used up: %v", err)
+		}
+		log.Printf("unable to create service %s, retrying in %s: %s\n", spec.Name, delay, err.Error())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func updateReplicas(ctx context.Context, cli dockerAPI, spec swarm.ServiceSpec) (found bool, updated bool, err error) {
+	/*
+		brings the replica count of an existing service in line with spec, leaving everything else about it alone.
+		found is false if there is no such service, updated is false if its count was already right
+	*/
+	service, _, err := cli.ServiceInspectWithRaw(ctx, spec.Name)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	if service.Spec.Mode.Replicated == nil || spec.Mode.Replicated == nil {
+		return true, false, errors.New("service " + spec.Name + " is not a replicated service")
+	}
+	replicas := *spec.Mode.Replicated.Replicas
+	if current := service.Spec.Mode.Replicated.Replicas; current != nil && *current == replicas {
+		// nothing to do
+		return true, false, nil
+	}
+	service.Spec.Mode.Replicated.Replicas = &replicas
+	_, err = cli.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+	return true, err == nil, err
+}
+
+func isConflict(err error) bool {
+	// the client has no typed error for a 409, so go by what swarm says
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "name conflicts with an existing object") || strings.Contains(msg, "already exists")
+}
+
+func updateService(ctx context.Context, cli dockerAPI, spec swarm.ServiceSpec) (bool, error) {
+	/*
+		replaces the spec of the existing service of the same name with spec, as long as it carries our stack label.
+		the spec hash label tells us if our spec has changed, the fingerprint if someone else changed the service -
+		returns false if neither
+	*/
+	service, _, err := cli.ServiceInspectWithRaw(ctx, spec.Name)
+	if err != nil {
+		return false, err
+	}
+	// the name may just as well belong to another stack, or to a service made by hand - only ever take over our own
+	if owner := service.Spec.Labels[stackLabel]; owner == "" || owner != spec.Labels[stackLabel] {
+		return false, fmt.Errorf("service %s already exists, but was not deployed by composer for stack %s - leaving it alone", spec.Name, spec.Labels[stackLabel])
+	}
+	modified := false
+	if fingerprint := service.Spec.Labels[fingerprintLabel]; fingerprint != "" && fingerprint != composerFingerprint(service.Spec) {
+		log.Printf("warning: service %s has been modified outside of composer, putting it back\n", spec.Name)
+		modified = true
+	}
+	if !modified && service.Spec.Labels[specHashLabel] != "" && service.Spec.Labels[specHashLabel] == spec.Labels[specHashLabel] {
+		return false, nil
+	}
+	_, err = cli.ServiceUpdate(ctx, service.ID, service.Version, spec, types.ServiceUpdateOptions{})
+	return err == nil, err
+}
+
+type serviceEvent struct {
+	Event     string `json:"event"`
+	Name      string `json:"name"`
+	Timestamp string `json:"timestamp"`
+}
+
+func notifyWebhook(url string, event string, name string) {
+	// best effort notification - tried twice, then logged and forgotten
+	if url == "" {
+		return
+	}
+	body, err := json.Marshal(serviceEvent{Event: event, Name: name, Timestamp: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		log.Printf("warning: unable to encode webhook event: %s\n", err.Error())
+		return
+	}
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	for attempt := 1; attempt <= 2; attempt++ {
+		resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = errors.New(resp.Status)
+		}
+		log.Printf("warning: webhook for %s %s failed (attempt %d): %s\n", event, name, attempt, err.Error())
+	}
+}
+
+func verifyNode(ctx context.Context, cli dockerAPI, id string) error {
+	// a service pinned to a node that isn't there, or can't take tasks, would just sit pending
+	node, _, err := cli.NodeInspectWithRaw(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return errors.New("node " + id + " does not exist")
+		}
+		return err
+	}
+	if node.Status.State != swarm.NodeStateReady || node.Spec.Availability != swarm.NodeAvailabilityActive {
+		return fmt.Errorf("node %s is not available (state %s, availability %s)", id, node.Status.State, node.Spec.Availability)
+	}
+	return nil
+}
+
+func overrideStackName(containerEnv env, name string) {
+	// --stack-name-override - lets one .env file serve several environments. blank leaves STACK_NAME alone
+	if name != "" {
+		containerEnv["STACK_NAME"] = kv{key: "STACK_NAME", value: name}
+	}
+}
+
+func purgeConfirmed(yes bool, containerEnv env) bool {
+	// removing everything is never done by accident - it takes --yes, or CONFIRM_PURGE=1
+	return yes || containerEnv["CONFIRM_PURGE"].value == "1"
+}
+
+func purgeServices(ctx context.Context, cli dockerAPI, w io.Writer) error {
+	// the teardown counterpart to a deploy - only ever touches services carrying our stack label
+	c := mustConfig(ctx)
+	if c.StackName == "" {
+		return errors.New("no STACK_NAME set, refusing to guess which services to remove")
+	}
+	services, err := ServiceListFilter(ctx, cli, c.StackName)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, service := range services {
+		if err := cli.ServiceRemove(ctx, service.ID); err != nil {
+			log.Printf("unable to remove service %s: %s\n", service.Spec.Name, err.Error())
+			failed = append(failed, service.Spec.Name)
+			continue
+		}
+		fmt.Fprintf(w, "removed %s\n", service.Spec.Name)
+		notifyWebhook(c.EventWebhookURL, "service_removed", service.Spec.Name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d services could not be removed: %s", len(failed), len(services), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func pruneServices(ctx context.Context, cli dockerAPI, w io.Writer, worklist []swarm.ServiceSpec, dryRun bool) error {
+	// anything carrying our stack label that isn't in the worklist has outlived its network, or its name
+	c := mustConfig(ctx)
+	if c.StackName == "" {
+		return errors.New("no STACK_NAME set, refusing to guess which services to remove")
+	}
+	expected := make(map[string]struct{})
+	for _, work := range worklist {
+		expected[work.Name] = struct{}{}
+	}
+	services, err := ServiceListFilter(ctx, cli, c.StackName)
+	if err != nil {
+		return err
+	}
+	// the api gives no ordering guarantee - sort, so the same services are deferred from run to run
+	sort.Slice(services, func(i, j int) bool { return services[i].Spec.Name < services[j].Spec.Name })
+	var failed []string
+	removals := 0
+	for _, service := range services {
+		if _, present := expected[service.Spec.Name]; present {
+			continue
+		}
+		if c.MaxChanges > 0 && removals >= c.MaxChanges {
+			// a removal is as much a change as a create - the rest are left for the next run
+			log.Printf("MAX_CHANGES_PER_CYCLE (%d) reached, deferring removal of %s\n", c.MaxChanges, service.Spec.Name)
+			continue
+		}
+		removals++
+		if dryRun {
+			fmt.Fprintf(w, "would prune %s\n", service.Spec.Name)
+			continue
+		}
+		if err := cli.ServiceRemove(ctx, service.ID); err != nil {
+			log.Printf("unable to remove service %s: %s\n", service.Spec.Name, err.Error())
+			failed = append(failed, service.Spec.Name)
+			continue
+		}
+		fmt.Fprintf(w, "pruned %s\n", service.Spec.Name)
+		notifyWebhook(c.EventWebhookURL, "service_removed", service.Spec.Name)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d services could not be removed: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func runPrune(ctx context.Context, cli dockerAPI, w io.Writer, networks []targetNetwork, containerEnv env, dryRun bool) error {
+	/*
+		run ahead of the checks a deploy needs (networks found, enough nodes), as a stack that has lost its networks
+		or nodes is just what prune is there to clean up. only the service names are needed, so no nodes are passed
+	*/
+	worklist, err := BuildWorklist(networks, nil, mustConfig(ctx), containerEnv)
+	if err != nil {
+		// the names for those networks are unknown, so their services would look stale
+		return errors.New("refusing to prune, " + err.Error())
+	}
+	return pruneServices(ctx, cli, w, worklist, dryRun)
+}
+
+func checkSwarmHealth(ctx context.Context, cli dockerAPI) error {
+	// without a manager quorum the swarm can't accept changes, and creates fail in odd ways - better to stop here
+	sw, err := cli.SwarmInspect(ctx)
+	if err != nil {
+		return err
+	}
+	if sw.ID == "" {
+		return errors.New("no swarm found")
+	}
+	list, err := cli.NodeList(ctx, types.NodeListOptions{})
+	if err != nil {
+		return err
+	}
+	managers, reachable, leader := 0, 0, false
+	for _, node := range list {
+		if node.ManagerStatus == nil {
+			continue
+		}
+		managers++
+		if node.ManagerStatus.Reachability == swarm.ReachabilityReachable {
+			reachable++
+		}
+		if node.ManagerStatus.Leader {
+			leader = true
+		}
+	}
+	if !leader {
+		return errors.New("no manager is currently the leader")
+	}
+	if reachable < managers/2+1 {
+		return fmt.Errorf("manager quorum lost: %d of %d managers reachable, need %d", reachable, managers, managers/2+1)
+	}
+	return nil
+}
+
+func tooFewNodes(c *config, nodes []string, breakdown nodeBreakdown) string {
+	// most likely a partial outage - deploying now would only need undoing once the nodes are back. blank if there are enough
+	if c.MinNodes > 0 && len(nodes) < c.MinNodes {
+		reason := fmt.Sprintf("only %d eligible nodes, MIN_NODES is %d (%s)", len(nodes), c.MinNodes, breakdown)
+		log.Printf("warning: %s - skipping this run\n", reason)
+		return reason
+	}
+	return ""
+}
+
+func runCheck(ctx context.Context, cli dockerAPI, w io.Writer) error {
+	// a quick sanity check: can we talk to docker, are we a swarm manager, and what would we target
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return errors.New("unable to connect to docker: " + err.Error())
+	}
+	if info.Swarm.LocalNodeState != swarm.LocalNodeStateActive {
+		return errors.New("swarm is not active on this node, state is: " + string(info.Swarm.LocalNodeState))
+	}
+	if !info.Swarm.ControlAvailable {
+		return errors.New("this node is not a swarm manager")
+	}
+	// the same check a real run would stop at
+	if err := checkSwarmHealth(ctx, cli); err != nil {
+		return errors.New("swarm is not healthy: " + err.Error())
+	}
+	networks := getNetworkList(ctx, cli)
+	nodes, _ := getNodeList(ctx, cli)
+	fmt.Fprintf(w, "docker %s, swarm active and healthy, manager\n", info.ServerVersion)
+	fmt.Fprintf(w, "%d networks and %d nodes would be targeted\n", len(networks), len(nodes))
+	return nil
+}
+
+// DeployReport summarises a run, for audit trails
+type DeployReport struct {
+	RunID      string    `json:"run_id"`
+	StartedAt  time.Time `json:"started_at"`
+	EndedAt    time.Time `json:"ended_at"`
+	DurationMs int64     `json:"duration_ms"`
+	Created    []string  `json:"created"`
+	Updated    []string  `json:"updated"`
+	Failed     []string  `json:"failed"`
+	Skipped    []string  `json:"skipped"`
+	Deferred   []string  `json:"deferred"`
+	// networks no service could be built for - kept apart from Failed, which holds service names
+	FailedNetworks []string `json:"failed_networks"`
+	// why the whole run was skipped, if it was
+	SkipReason string `json:"skip_reason,omitempty"`
+}
+
+func (r DeployReport) failureSummary(networks, services int) string {
+	// blank if nothing failed
+	failures := []string{}
+	if len(r.FailedNetworks) > 0 {
+		failures = append(failures, fmt.Sprintf("%d of %d networks could not be built: %s", len(r.FailedNetworks), networks, strings.Join(r.FailedNetworks, ", ")))
+	}
+	if len(r.Failed) > 0 {
+		failures = append(failures, fmt.Sprintf("%d of %d services failed: %s", len(r.Failed), services, strings.Join(r.Failed, ", ")))
+	}
+	return strings.Join(failures, "; ")
+}
+
+func newRunID() string {
+	// short and random - just enough to pick one run's lines out of interleaved logs
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// WriteReport writes r to path as json
+// finish stamps the end of the run onto the report, and writes it to path - unless path is blank
+func (r *DeployReport) finish(path string) {
+	r.EndedAt = time.Now().UTC()
+	r.DurationMs = int64(r.EndedAt.Sub(r.StartedAt) / time.Millisecond)
+	if path == "" {
+		return
+	}
+	if err := WriteReport(path, *r); err != nil {
+		log.Printf("unable to write report: %s\n", err.Error())
+	}
+}
+
+func WriteReport(path string, r DeployReport) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+func executeWorklist(ctx context.Context, cli dockerAPI, worklist []swarm.ServiceSpec, networks []targetNetwork, report *DeployReport) {
+	// runs the worklist sequentially. a failed service is recorded, and we carry on with the next
+	c := mustConfig(ctx)
+	names := getNetworkNames(networks)
+	stagger := false
+	for _, work := range worklist {
+		if getRetryBudget(ctx).exhausted() {
+			// something is badly wrong - give up on this run rather than keep hammering docker
+			log.Printf("MAX_CYCLE_RETRIES used up, not trying %s\n", work.Name)
+			report.Failed = append(report.Failed, work.Name)
+			continue
+		}
+		if c.MaxChanges > 0 && len(report.Created)+len(report.Updated) >= c.MaxChanges {
+			/*
+				enough change for one run - the rest is left for the next. services already done are found to be
+				up to date next time round, and don't count, so repeated runs converge
+			*/
+			log.Printf("MAX_CHANGES_PER_CYCLE (%d) reached, deferring %s\n", c.MaxChanges, work.Name)
+			report.Deferred = append(report.Deferred, work.Name)
+			continue
+		}
+		if stagger {
+			select {
+			case <-time.After(c.CreateStagger):
+			case <-ctx.Done():
+				return
+			}
+		}
+		// each service gets its own time budget, so one slow service can't use up the whole run
+		created := len(report.Created)
+		applyCtx, cancel := context.WithTimeout(ctx, c.ApplyTimeout)
+		applyService(applyCtx, cli, work, names[getTargetNetwork(work)], report)
+		cancel()
+		stagger = c.CreateStagger > 0 && len(report.Created) > created
+	}
+}
+
+func applyService(ctx context.Context, cli dockerAPI, work swarm.ServiceSpec, network string, report *DeployReport) {
+	c := mustConfig(ctx)
+	if c.ReconcileOnly {
+		found, updated, err := updateReplicas(ctx, cli, work)
+		if err != nil {
+			log.Printf("unable to update service: %s\n", err.Error())
+			report.Failed = append(report.Failed, work.Name)
+			return
+		}
+		if !found {
+			log.Printf("warning: no service %s found for network %s, not creating it as RECONCILE_ONLY is set\n", work.Name, network)
+			report.Skipped = append(report.Skipped, work.Name)
+			return
+		}
+		if !updated {
+			// already at the right count - not a change, so no event and nothing against MAX_CHANGES_PER_CYCLE
+			log.Printf("service already up to date: %s\n", work.Name)
+			report.Skipped = append(report.Skipped, work.Name)
+			return
+		}
+		log.Printf("reconciled service: %s\n", work.Name)
+		report.Updated = append(report.Updated, work.Name)
+		notifyWebhook(c.EventWebhookURL, "service_updated", work.Name)
+		return
+	}
+	if err := runHook(ctx, c.PreDeployHook, work.Name, network); err != nil {
+		// the pre-deploy hook gets a say in whether the service goes ahead
+		log.Printf("not deploying service %s: %s\n", work.Name, err.Error())
+		report.Failed = append(report.Failed, work.Name)
+		return
+	}
+	err := createService(ctx, cli, work)
+	if isConflict(err) {
+		// already there (left over, or another composer got there first) - make it match instead
+		updated, err := updateService(ctx, cli, work)
+		if err != nil {
+			log.Printf("unable to update existing service: %s\n", err.Error())
+			report.Failed = append(report.Failed, work.Name)
+			return
+		}
+		if updated {
+			log.Printf("updated existing service: %s\n", work.Name)
+			report.Updated = append(report.Updated, work.Name)
+			notifyWebhook(c.EventWebhookURL, "service_updated", work.Name)
+		} else {
+			log.Printf("service already up to date: %s\n", work.Name)
+			report.Skipped = append(report.Skipped, work.Name)
+		}
+		runPostDeployHook(ctx, work.Name, network)
+		return
+	}
+	if err != nil {
+		log.Printf("unable to create service: %s\n", err.Error())
+		report.Failed = append(report.Failed, work.Name)
+		return
+	}
+	log.Printf("created server: %s\n", work.Name)
+	report.Created = append(report.Created, work.Name)
+	notifyWebhook(c.EventWebhookURL, "service_created", work.Name)
+	runPostDeployHook(ctx, work.Name, network)
+}
+
+func runPostDeployHook(ctx context.Context, serviceName string, network string) {
+	// the service is already there by now, so a failure can only be reported
+	if err := runHook(ctx, mustConfig(ctx).PostDeployHook, serviceName, network); err != nil {
+		log.Printf("warning: post-deploy hook for service %s: %s\n", serviceName, err.Error())
+	}
+}
+
+// the networks, by name, that no service could be built for
+type worklistError map[string]error
+
+func (e worklistError) Error() string {
+	failed := []string{}
+	for name, err := range e {
+		failed = append(failed, name+": "+err.Error())
+	}
+	sort.Strings(failed)
+	return "unable to build services for " + strings.Join(failed, ", ")
+}
+
+// BuildWorklist returns the service specs for networks and nodes, without talking to docker. if some networks
+// fail, the specs for the rest are still returned, along with a worklistError
+func BuildWorklist(networks []targetNetwork, nodes []string, cfg *config, containerEnv env) ([]swarm.ServiceSpec, error) {
+	ctx := WithConfig(context.Background(), cfg)
+	worklist := []swarm.ServiceSpec{}
+	failed := worklistError{}
+
+	/*
+		We need to modify the basic container environment for each stack. here we create a structure for handling this
+	*/
+	configs := make(map[string]env)
+	for _, network := range networks {
+		configs[network.id] = containerEnv
+	}
+
+	/*
+		Create the service config specific for this network
+	*/
+	for _, network := range networks {
 		numberOfNodes := len(nodes)
-		s := getServiceDefinition(cli, uint64(numberOfNodes*c.PnPn), network, configs)
+		replicas := uint64(numberOfNodes * cfg.PnPn)
+		if cfg.CapReplicasByPeers && network.peers > 0 && replicas > uint64(network.peers*cfg.PnPn) {
+			// no point in placing more than the network can reach
+			replicas = uint64(network.peers * cfg.PnPn)
+		}
+		if override, present := getReplicaOverride(cfg, network.name); present {
+			replicas = override
+		}
+		s, err := getServiceDefinition(ctx, replicas, network, configs)
+		if err != nil {
+			failed[network.name] = err
+			continue
+		}
 		worklist = append(worklist, s)
 	}
 
-	ctx := context.Background()
-	// execute worklist sequentially
-	for _, work := range worklist {
-		_, err := cli.ServiceCreate(ctx, work, types.ServiceCreateOptions{})
+	if len(failed) > 0 {
+		return worklist, failed
+	}
+	return worklist, nil
+}
+
+func main() {
+	flag.Parse()
+	runID := newRunID()
+	log.SetPrefix("[" + runID + "] ")
+	report := DeployReport{RunID: runID, StartedAt: time.Now().UTC(), Created: []string{}, Updated: []string{}, Failed: []string{}, Skipped: []string{}, Deferred: []string{}, FailedNetworks: []string{}}
+
+	// get client environment
+	containerEnv := getcontainerEnv()
+	overrideStackName(containerEnv, *stackOverride)
+	// get config
+	c, err := getConfig(containerEnv, *noDefaultAvoid)
+	if err != nil {
+		log.Fatalf("startup failed due to a config error: %s", err.Error())
+	}
+	if *eventWebhook != "" {
+		c.EventWebhookURL = *eventWebhook
+	}
+	if *applyTimeout <= 0 {
+		log.Fatalf("startup failed due to a config error: --apply-timeout must be positive, got %d", *applyTimeout)
+	}
+	c.ApplyTimeout = time.Duration(*applyTimeout) * time.Second
+	if *nodeFilter != "" {
+		c.NodeFilter = getSubStringsMap(*nodeFilter)
+	}
+
+	if containerEnv["ENV_DUMP"].value == "1" {
+		// print what we ended up with, and leave docker alone
+		if err := dumpConfig(os.Stdout, c, containerEnv); err != nil {
+			log.Fatalf("unable to dump config: %s", err.Error())
+		}
+		return
+	}
+
+	ctx := withRetryBudget(WithConfig(context.Background(), &c), c.MaxCycleRetries)
+
+	cli, err := newDockerClient(ctx)
+	if err != nil {
+		log.Fatalf("unable to create docker client: %s\n", err.Error())
+	}
+
+	if *check {
+		if err := runCheck(ctx, cli, os.Stdout); err != nil {
+			log.Fatalf("check failed: %s\n", err.Error())
+		}
+		return
+	}
+
+	if *purge {
+		if !purgeConfirmed(*confirm, containerEnv) {
+			log.Fatalln("refusing to purge without --yes or CONFIRM_PURGE=1")
+		}
+		if err := purgeServices(ctx, cli, os.Stdout); err != nil {
+			log.Fatalf("purge failed: %s\n", err.Error())
+		}
+		return
+	}
+
+	if c.NodeID != "" {
+		if err := verifyNode(ctx, cli, c.NodeID); err != nil {
+			log.Fatalf("invalid SERVICE_NODE_ID: %s\n", err.Error())
+		}
+	}
+
+	if err := checkSwarmHealth(ctx, cli); err != nil {
+		log.Fatalf("swarm is not healthy: %s\n", err.Error())
+	}
+
+	// get network list
+	networks := getNetworkList(ctx, cli)
+	if *prune {
+		if err := runPrune(ctx, cli, os.Stdout, networks, containerEnv, *pruneDryRun); err != nil {
+			log.Fatalf("prune failed: %s\n", err.Error())
+		}
+		return
+	}
+	if len(networks) == 0 {
+		log.Fatalln("no overlay networks found")
+	}
+
+	if *networkStatus {
+		if err := printNetworkStatus(ctx, cli, os.Stdout, networks); err != nil {
+			log.Fatalf("unable to get network status: %s\n", err.Error())
+		}
+		return
+	}
+
+	// get network list
+	nodes, breakdown := getNodeList(ctx, cli)
+	if reason := tooFewNodes(&c, nodes, breakdown); reason != "" {
+		// still worth a report, so whatever watches it can tell a skipped run from one that never ran
+		report.SkipReason = reason
+		report.finish(*reportFile)
+		return
+	}
+	c.ExcludedNodes = breakdown.excluded
+	if len(nodes) <= 1 {
+		if c.PnPn <= 1 {
+			// is pointless deploying a single container into a network on a single node...it will, by definition have NO peers to poll
+			log.Fatalf("no useable nodes found - %s\n", breakdown)
+		}
+	} else {
+		// as we have multiple nodes, ensure PNPN is set to 1
+		c.PnPn = 1
+	}
+
+	for i, network := range networks {
+		if !c.CapReplicasByPeers && !c.Debug {
+			// one inspect per network - only worth it when the count is used or asked for
+			break
+		}
+		peers, err := getPeerNodeCount(ctx, cli, network.id)
 		if err != nil {
-			log.Fatalf("unable to create service: %s\n", err.Error())
+			log.Printf("unable to count peers on network %s: %s\n", network.name, err.Error())
+			continue
+		}
+		log.Printf("network %s has %d peer nodes\n", network.name, peers)
+		networks[i].peers = peers
+	}
+
+	// build the workslist
+	worklist, err := BuildWorklist(networks, nodes, &c, containerEnv)
+	if werr, ok := err.(worklistError); ok {
+		// those networks are skipped, the rest may well be fine - but they still count against the run
+		for _, network := range networks {
+			if err, present := werr[network.name]; present {
+				log.Printf("unable to build service for network %s: %s\n", network.name, err.Error())
+				report.FailedNetworks = append(report.FailedNetworks, network.name)
+			}
+		}
+	} else if err != nil {
+		log.Fatalf("unable to build worklist: %s\n", err.Error())
+	}
+
+	if *serviceList {
+		if err := printServiceList(os.Stdout, worklist, networks); err != nil {
+			log.Fatalf("unable to print service list: %s", err.Error())
 		}
-		fmt.Printf("created server: %s\n", work.Name)
+		return
+	}
+
+	executeWorklist(ctx, cli, worklist, networks, &report)
+
+	report.finish(*reportFile)
+	if summary := report.failureSummary(len(networks), len(worklist)); summary != "" {
+		log.Fatalln(summary)
 	}
 
 }
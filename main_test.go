@@ -0,0 +1,4009 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// fakeDocker stands in for the docker client. services are keyed by name, and every change made through it is
+// recorded so the tests can check what composer asked for
+type fakeDocker struct {
+	info       types.Info
+	swarm      swarm.Swarm
+	networks   []types.NetworkResource
+	networkErr error
+	nodes      []swarm.Node
+	services   map[string]swarm.Service
+	createErrs []error
+	// how long a create of each service name takes - like the daemon, it gives up if the caller does
+	createDelay map[string]time.Duration
+	// how many times the services were listed
+	serviceLists int
+	// the filters each list call was last made with
+	networkFilters filters.Args
+	nodeFilters    filters.Args
+	serviceFilters filters.Args
+
+	created []string
+	updated []string
+	removed []string
+}
+
+type fakeNotFound struct {
+	what string
+}
+
+func (e fakeNotFound) Error() string {
+	return "Error: No such " + e.what
+}
+
+func (e fakeNotFound) NotFound() bool {
+	return true
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{services: make(map[string]swarm.Service)}
+}
+
+func (f *fakeDocker) addService(spec swarm.ServiceSpec) swarm.Service {
+	service := swarm.Service{ID: "id-" + spec.Name, Spec: spec}
+	f.services[spec.Name] = service
+	return service
+}
+
+func (f *fakeDocker) findService(nameOrID string) (swarm.Service, bool) {
+	for name, service := range f.services {
+		if name == nameOrID || service.ID == nameOrID {
+			return service, true
+		}
+	}
+	return swarm.Service{}, false
+}
+
+func (f *fakeDocker) Info(ctx context.Context) (types.Info, error) {
+	return f.info, nil
+}
+
+func (f *fakeDocker) SwarmInspect(ctx context.Context) (swarm.Swarm, error) {
+	return f.swarm, nil
+}
+
+func (f *fakeDocker) NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error) {
+	// filters are ignored, like an old engine would - composer checks the results itself
+	f.networkFilters = options.Filters
+	if f.networkErr != nil {
+		return nil, f.networkErr
+	}
+	list := make([]types.NetworkResource, len(f.networks))
+	copy(list, f.networks)
+	return list, nil
+}
+
+func (f *fakeDocker) NetworkInspect(ctx context.Context, networkID string) (types.NetworkResource, error) {
+	for _, network := range f.networks {
+		if network.ID == networkID || network.Name == networkID {
+			return network, nil
+		}
+	}
+	return types.NetworkResource{}, fakeNotFound{"network: " + networkID}
+}
+
+func (f *fakeDocker) NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error) {
+	f.nodeFilters = options.Filters
+	return f.nodes, nil
+}
+
+func (f *fakeDocker) NodeInspectWithRaw(ctx context.Context, nodeID string) (swarm.Node, []byte, error) {
+	for _, node := range f.nodes {
+		if node.ID == nodeID {
+			return node, nil, nil
+		}
+	}
+	return swarm.Node{}, nil, fakeNotFound{"node: " + nodeID}
+}
+
+func (f *fakeDocker) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	f.serviceLists++
+	f.serviceFilters = options.Filters
+	list := []swarm.Service{}
+	for _, service := range f.services {
+		if options.Filters.Include("label") && !options.Filters.MatchKVList("label", service.Spec.Labels) {
+			continue
+		}
+		list = append(list, service)
+	}
+	return list, nil
+}
+
+func (f *fakeDocker) ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error) {
+	if service, found := f.findService(serviceID); found {
+		return service, nil, nil
+	}
+	return swarm.Service{}, nil, fakeNotFound{"service: " + serviceID}
+}
+
+func (f *fakeDocker) ServiceCreate(ctx context.Context, spec swarm.ServiceSpec, options types.ServiceCreateOptions) (types.ServiceCreateResponse, error) {
+	if delay := f.createDelay[spec.Name]; delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return types.ServiceCreateResponse{}, ctx.Err()
+		}
+	}
+	if len(f.createErrs) > 0 {
+		err := f.createErrs[0]
+		f.createErrs = f.createErrs[1:]
+		if err != nil {
+			return types.ServiceCreateResponse{}, err
+		}
+	}
+	if _, found := f.services[spec.Name]; found {
+		return types.ServiceCreateResponse{}, errors.New("Error response from daemon: rpc error: code = 2 desc = name conflicts with an existing object")
+	}
+	service := f.addService(spec)
+	f.created = append(f.created, spec.Name)
+	return types.ServiceCreateResponse{ID: service.ID}, nil
+}
+
+func (f *fakeDocker) ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, spec swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error) {
+	service, found := f.findService(serviceID)
+	if !found {
+		return types.ServiceUpdateResponse{}, fakeNotFound{"service: " + serviceID}
+	}
+	service.Spec = spec
+	f.services[service.Spec.Name] = service
+	f.updated = append(f.updated, spec.Name)
+	return types.ServiceUpdateResponse{}, nil
+}
+
+func (f *fakeDocker) ServiceRemove(ctx context.Context, serviceID string) error {
+	service, found := f.findService(serviceID)
+	if !found {
+		return fakeNotFound{"service: " + serviceID}
+	}
+	delete(f.services, service.Spec.Name)
+	f.removed = append(f.removed, service.Spec.Name)
+	return nil
+}
+
+// testEnv builds an env from KEY=value pairs, the way getcontainerEnv would have read them
+func testEnv(pairs ...string) env {
+	e := make(env)
+	for _, pair := range pairs {
+		k, v := getKeyValue(pair)
+		e[k] = kv{key: k, value: v}
+	}
+	return e
+}
+
+// baseEnv is the smallest env that a service can be built from, plus any extra pairs
+func baseEnv(pairs ...string) env {
+	return testEnv(append([]string{"STACK_NAME=probe", "SERVICE_NAME=pinger", "IMAGE=pinger:1.0"}, pairs...)...)
+}
+
+func testConfig(t testing.TB, e env) *config {
+	t.Helper()
+	c, err := getConfig(e, false)
+	if err != nil {
+		t.Fatalf("getConfig: %v", err)
+	}
+	// main sets this from --apply-timeout
+	c.ApplyTimeout = time.Duration(*applyTimeout) * time.Second
+	return &c
+}
+
+func testContext(c *config) context.Context {
+	return WithConfig(context.Background(), c)
+}
+
+// inDir runs f with the working directory set to a fresh temporary directory holding a .env made of lines
+func inDir(t *testing.T, lines []string, f func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "composer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// keep the secrets of whatever machine runs the tests out of it
+	lines = append(lines, "ENV_SECRETS_DIR="+dir+"/secrets")
+	if err := ioutil.WriteFile(dir+"/.env", []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	f()
+}
+
+func testNetworks(names ...string) []targetNetwork {
+	networks := []targetNetwork{}
+	for i, name := range names {
+		networks = append(networks, targetNetwork{id: fmt.Sprintf("%s-id-%d", name, i), name: name, key: name})
+	}
+	return networks
+}
+
+func replicasOf(spec swarm.ServiceSpec) uint64 {
+	if spec.Mode.Replicated == nil || spec.Mode.Replicated.Replicas == nil {
+		return 0
+	}
+	return *spec.Mode.Replicated.Replicas
+}
+
+func TestBuildWorklist(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          env
+		networks     []targetNetwork
+		nodes        []string
+		peers        map[string]int
+		wantNames    []string
+		wantReplicas []uint64
+		wantTask     bool
+	}{
+		{
+			name:         "one service per network, one replica per node",
+			env:          baseEnv(),
+			networks:     testNetworks("net1", "net2"),
+			nodes:        []string{"node1", "node2", "node3"},
+			wantNames:    []string{"probe_net1_pinger", "probe_net2_pinger"},
+			wantReplicas: []uint64{3, 3},
+		},
+		{
+			name:         "pnpn multiplies the replicas",
+			env:          baseEnv("PNPN=4"),
+			networks:     testNetworks("net1"),
+			nodes:        []string{"node1"},
+			wantNames:    []string{"probe_net1_pinger"},
+			wantReplicas: []uint64{4},
+		},
+		{
+			name:         "replica override for one network",
+			env:          baseEnv("REPLICA_OVERRIDES=net2=7"),
+			networks:     testNetworks("net1", "net2"),
+			nodes:        []string{"node1", "node2"},
+			wantNames:    []string{"probe_net1_pinger", "probe_net2_pinger"},
+			wantReplicas: []uint64{2, 7},
+		},
+		{
+			name:         "replicas capped by peers",
+			env:          baseEnv("REPLICAS_CAP_BY_PEERS=1"),
+			networks:     testNetworks("net1", "net2"),
+			nodes:        []string{"node1", "node2", "node3"},
+			peers:        map[string]int{"net1": 2},
+			wantNames:    []string{"probe_net1_pinger", "probe_net2_pinger"},
+			wantReplicas: []uint64{2, 3},
+		},
+		{
+			name:         "attached at task level",
+			env:          baseEnv("NETWORK_ATTACHMENT_LEVEL=task"),
+			networks:     testNetworks("net1"),
+			nodes:        []string{"node1", "node2"},
+			wantNames:    []string{"probe_net1_pinger"},
+			wantReplicas: []uint64{2},
+			wantTask:     true,
+		},
+		{
+			name:         "no networks, no work",
+			env:          baseEnv(),
+			networks:     testNetworks(),
+			nodes:        []string{"node1", "node2"},
+			wantNames:    []string{},
+			wantReplicas: []uint64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := range tt.networks {
+				tt.networks[i].peers = tt.peers[tt.networks[i].name]
+			}
+			worklist, err := BuildWorklist(tt.networks, tt.nodes, testConfig(t, tt.env), tt.env)
+			if err != nil {
+				t.Fatalf("BuildWorklist: %v", err)
+			}
+			if len(worklist) != len(tt.wantNames) {
+				t.Fatalf("got %d specs, want %d", len(worklist), len(tt.wantNames))
+			}
+			for i, spec := range worklist {
+				if spec.Name != tt.wantNames[i] {
+					t.Errorf("spec %d: name %q, want %q", i, spec.Name, tt.wantNames[i])
+				}
+				if got := replicasOf(spec); got != tt.wantReplicas[i] {
+					t.Errorf("spec %d: %d replicas, want %d", i, got, tt.wantReplicas[i])
+				}
+				if got := getTargetNetwork(spec); got != tt.networks[i].id {
+					t.Errorf("spec %d: attached to %q, want %q", i, got, tt.networks[i].id)
+				}
+				if tt.wantTask != (len(spec.TaskTemplate.Networks) == 1) || tt.wantTask == (len(spec.Networks) == 1) {
+					t.Errorf("spec %d: service networks %v, task networks %v", i, spec.Networks, spec.TaskTemplate.Networks)
+				}
+				if spec.TaskTemplate.ContainerSpec.Image != "pinger:1.0" {
+					t.Errorf("spec %d: image %q", i, spec.TaskTemplate.ContainerSpec.Image)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildWorklistErrors(t *testing.T) {
+	e := testEnv("STACK_NAME=probe", "SERVICE_NAME=pinger")
+	worklist, err := BuildWorklist(testNetworks("net1", "net2"), []string{"node1", "node2"}, testConfig(t, e), e)
+	werr, ok := err.(worklistError)
+	if !ok {
+		t.Fatalf("got %v, want a worklistError", err)
+	}
+	if len(worklist) != 0 {
+		t.Errorf("got %d specs, want none", len(worklist))
+	}
+	for _, name := range []string{"net1", "net2"} {
+		if werr[name] == nil || !strings.Contains(werr[name].Error(), "IMAGE") {
+			t.Errorf("network %s: got %v, want an error naming IMAGE", name, werr[name])
+		}
+	}
+}
+
+func TestGetcontainerEnv(t *testing.T) {
+	lines := []string{
+		"# a comment",
+		"STACK_NAME=probe",
+		"CONTAINER_LABELS=com.example.logs=pinger,com.example.team=net",
+		"LOG_DRIVER_OPTS=max-size=10m",
+		"EVENT_WEBHOOK_URL=https://hooks.example.com/composer?token=X&env=prod",
+		"EMPTY=",
+		"FLAG",
+	}
+	want := map[string]string{
+		"STACK_NAME":        "probe",
+		"CONTAINER_LABELS":  "com.example.logs=pinger,com.example.team=net",
+		"LOG_DRIVER_OPTS":   "max-size=10m",
+		"EVENT_WEBHOOK_URL": "https://hooks.example.com/composer?token=X&env=prod",
+		"EMPTY":             "",
+		"FLAG":              "",
+	}
+	inDir(t, lines, func() {
+		e := getcontainerEnv()
+		for k, v := range want {
+			got, present := e[k]
+			if !present {
+				t.Errorf("%s: missing", k)
+				continue
+			}
+			if got.value != v {
+				t.Errorf("%s: got %q, want %q", k, got.value, v)
+			}
+		}
+	})
+}
+
+func TestGetcontainerEnvCRLF(t *testing.T) {
+	// as saved by a windows editor - inDir adds the \n
+	lines := []string{
+		"# a comment\r",
+		"STACK_NAME=probe\r",
+		"\r",
+		"SERVICE_NAME=web\r",
+		"  # an indented comment\r",
+		"AVOID_NETWORKS=backend,frontend\r",
+		"EMPTY=\r",
+	}
+	want := map[string]string{
+		"STACK_NAME":     "probe",
+		"SERVICE_NAME":   "web",
+		"AVOID_NETWORKS": "backend,frontend",
+		"EMPTY":          "",
+	}
+	inDir(t, lines, func() {
+		e := getcontainerEnv()
+		for k, v := range want {
+			got, present := e[k]
+			if !present {
+				t.Errorf("%s: missing", k)
+				continue
+			}
+			if got.value != v || got.key != k {
+				t.Errorf("%s: got %q=%q, want %q", k, got.key, got.value, v)
+			}
+		}
+		for k := range e {
+			if strings.ContainsAny(k, "\r#") {
+				t.Errorf("got key %q", k)
+			}
+		}
+		c, err := getConfig(e, false)
+		if err != nil {
+			t.Fatalf("getConfig: %v", err)
+		}
+		if _, present := c.AvoidNetworks["frontend"]; !present {
+			t.Errorf("AVOID_NETWORKS: got %v", c.AvoidNetworks)
+		}
+	})
+}
+
+func TestKeyValueListsFromEnvFile(t *testing.T) {
+	// every key=value list option has to survive the trip through .env
+	lines := []string{
+		"CONTAINER_LABELS=com.example.logs=pinger",
+		"LOG_DRIVER=json-file",
+		"LOG_DRIVER_OPTS=max-size=10m",
+		"REPLICA_OVERRIDES=net1=3",
+		"ENGINE_LABELS=zone=a",
+	}
+	inDir(t, lines, func() {
+		c, err := getConfig(getcontainerEnv(), false)
+		if err != nil {
+			t.Fatalf("getConfig: %v", err)
+		}
+		if got := c.ContainerLabels["com.example.logs"]; got != "pinger" {
+			t.Errorf("CONTAINER_LABELS: got %q", got)
+		}
+		if got := c.LogDriverOpts["max-size"]; got != "10m" {
+			t.Errorf("LOG_DRIVER_OPTS: got %q", got)
+		}
+		if got := c.ReplicaOverrides["net1"]; got != 3 {
+			t.Errorf("REPLICA_OVERRIDES: got %d", got)
+		}
+		if want := []string{"engine.labels.zone==a"}; !reflect.DeepEqual(c.PlacementConstraints, want) {
+			t.Errorf("ENGINE_LABELS: got %v, want %v", c.PlacementConstraints, want)
+		}
+	})
+}
+
+func TestContainerLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "unset", value: "", want: nil},
+		{name: "one", value: "com.example.logs=pinger", want: map[string]string{"com.example.logs": "pinger"}},
+		{name: "two", value: "a=1, b=2", want: map[string]string{"a": "1", "b": "2"}},
+		{name: "value with =", value: "expr=a=b", want: map[string]string{"expr": "a=b"}},
+		{name: "no value", value: "a", wantErr: true},
+		{name: "no key", value: "=1", wantErr: true},
+		{name: "empty pair", value: "a=1,,b=2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv()
+			if tt.value != "" {
+				e["CONTAINER_LABELS"] = kv{key: "CONTAINER_LABELS", value: tt.value}
+			}
+			c, err := getConfig(e, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			spec, err := getServiceDefinition(testContext(&c), 1, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+			if err != nil {
+				t.Fatalf("getServiceDefinition: %v", err)
+			}
+			if got := spec.TaskTemplate.ContainerSpec.Labels; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("container labels: got %v, want %v", got, tt.want)
+			}
+			// the service labels are ours, and never mixed with the container ones
+			for k := range tt.want {
+				if _, present := spec.Labels[k]; present {
+					t.Errorf("container label %s also set on the service", k)
+				}
+			}
+			if spec.Labels[stackLabel] != "probe" {
+				t.Errorf("service labels: got %v", spec.Labels)
+			}
+		})
+	}
+}
+
+func TestTaskHostname(t *testing.T) {
+	tests := []struct {
+		name    string
+		pairs   []string
+		want    string
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "template", pairs: []string{"TASK_HOSTNAME={{.Service.Name}}.{{.Node.Hostname}}"}, want: "{{.Service.Name}}.{{.Node.Hostname}}"},
+		{name: "plain name", pairs: []string{"TASK_HOSTNAME=pinger"}, want: "pinger"},
+		{name: "empty", pairs: []string{"TASK_HOSTNAME="}, wantErr: true},
+		{name: "blank", pairs: []string{"TASK_HOSTNAME=  "}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv(tt.pairs...)
+			c, err := getConfig(e, false)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "TASK_HOSTNAME") {
+					t.Fatalf("got %v, want an error about TASK_HOSTNAME", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			spec, err := getServiceDefinition(testContext(&c), 1, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+			if err != nil {
+				t.Fatalf("getServiceDefinition: %v", err)
+			}
+			// left for swarm to expand, per task
+			if got := spec.TaskTemplate.ContainerSpec.Hostname; got != tt.want {
+				t.Errorf("hostname: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogDriver(t *testing.T) {
+	tests := []struct {
+		name    string
+		pairs   []string
+		want    *swarm.Driver
+		wantErr bool
+	}{
+		{name: "engine default"},
+		{name: "driver only", pairs: []string{"LOG_DRIVER=syslog"}, want: &swarm.Driver{Name: "syslog"}},
+		{
+			name:  "driver and options",
+			pairs: []string{"LOG_DRIVER=gelf", "LOG_DRIVER_OPTS=gelf-address=udp://logs.example.com:12201,tag=pinger"},
+			want:  &swarm.Driver{Name: "gelf", Options: map[string]string{"gelf-address": "udp://logs.example.com:12201", "tag": "pinger"}},
+		},
+		{name: "options without a driver", pairs: []string{"LOG_DRIVER_OPTS=tag=pinger"}, wantErr: true},
+		{name: "bad options", pairs: []string{"LOG_DRIVER=gelf", "LOG_DRIVER_OPTS=tag"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv(tt.pairs...)
+			c, err := getConfig(e, false)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "LOG_DRIVER") {
+					t.Fatalf("got %v, want an error about LOG_DRIVER", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			spec, err := getServiceDefinition(testContext(&c), 1, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+			if err != nil {
+				t.Fatalf("getServiceDefinition: %v", err)
+			}
+			if got := spec.TaskTemplate.LogDriver; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("log driver: got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	tests := []struct {
+		name    string
+		pairs   []string
+		want    map[string]string
+		wantErr string
+	}{
+		{name: "json-file", pairs: []string{"LOG_DRIVER=json-file", "LOG_MAX_SIZE=10m", "LOG_MAX_FILE=5"}, want: map[string]string{"max-size": "10m", "max-file": "5"}},
+		{name: "local, size only", pairs: []string{"LOG_DRIVER=local", "LOG_MAX_SIZE=512k"}, want: map[string]string{"max-size": "512k"}},
+		{name: "files only", pairs: []string{"LOG_DRIVER=json-file", "LOG_MAX_FILE=1"}, want: map[string]string{"max-file": "1"}},
+		{
+			name:  "merged with the driver options",
+			pairs: []string{"LOG_DRIVER=json-file", "LOG_DRIVER_OPTS=compress=true,max-size=1g", "LOG_MAX_SIZE=2g"},
+			want:  map[string]string{"compress": "true", "max-size": "2g"},
+		},
+		{name: "not a file driver", pairs: []string{"LOG_DRIVER=syslog", "LOG_MAX_SIZE=10m"}, wantErr: "require LOG_DRIVER"},
+		{name: "no driver", pairs: []string{"LOG_MAX_FILE=5"}, wantErr: "require LOG_DRIVER"},
+		{name: "size without a unit", pairs: []string{"LOG_DRIVER=json-file", "LOG_MAX_SIZE=10"}, wantErr: "LOG_MAX_SIZE"},
+		{name: "size in megabytes", pairs: []string{"LOG_DRIVER=json-file", "LOG_MAX_SIZE=10mb"}, wantErr: "LOG_MAX_SIZE"},
+		{name: "size upper case", pairs: []string{"LOG_DRIVER=json-file", "LOG_MAX_SIZE=10M"}, wantErr: "LOG_MAX_SIZE"},
+		{name: "no files", pairs: []string{"LOG_DRIVER=json-file", "LOG_MAX_FILE=0"}, wantErr: "LOG_MAX_FILE"},
+		{name: "files not a number", pairs: []string{"LOG_DRIVER=json-file", "LOG_MAX_FILE=five"}, wantErr: "LOG_MAX_FILE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := getConfig(baseEnv(tt.pairs...), false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			if !reflect.DeepEqual(c.LogDriverOpts, tt.want) {
+				t.Errorf("got %v, want %v", c.LogDriverOpts, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintServiceList(t *testing.T) {
+	networks := []targetNetwork{{id: "net1-id", name: "net1"}, {id: "backend-id", name: "backend"}}
+	worklist := []swarm.ServiceSpec{
+		attachedSpec("probe_net1_pinger", "probe", "net1-id"),
+		attachedSpec("probe_backend_pinger", "probe", "backend-id"),
+		attachedSpec("p", "probe", "net1-id"),
+	}
+	for i := range worklist {
+		worklist[i].TaskTemplate.ContainerSpec.Image = "pinger:1.0"
+	}
+	var out bytes.Buffer
+	if err := printServiceList(&out, worklist, networks); err != nil {
+		t.Fatal(err)
+	}
+	// each column as wide as its longest entry, plus two spaces
+	want := "probe_net1_pinger     net1     pinger:1.0\n" +
+		"probe_backend_pinger  backend  pinger:1.0\n" +
+		"p                     net1     pinger:1.0\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		if strings.HasSuffix(line, " ") || strings.Contains(line, "\t") {
+			t.Errorf("line %q has tabs or trailing spaces", line)
+		}
+		if fields := strings.Fields(line); len(fields) != 3 {
+			t.Errorf("line %q: got %d fields, want 3", line, len(fields))
+		}
+	}
+
+	// nothing to deploy, nothing printed
+	out.Reset()
+	if err := printServiceList(&out, nil, networks); err != nil || out.Len() != 0 {
+		t.Errorf("empty worklist: got %q, %v", out.String(), err)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs []string
+		want  []string
+	}{
+		// nothing hardcoded - the image's entrypoint runs
+		{name: "default"},
+		{name: "blank", pairs: []string{"COMMAND=  "}},
+		{name: "one word", pairs: []string{"COMMAND=/go/bin/pinger"}, want: []string{"/go/bin/pinger"}},
+		{name: "with arguments", pairs: []string{"COMMAND=/usr/local/bin/probe  --port 8111"}, want: []string{"/usr/local/bin/probe", "--port", "8111"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv(tt.pairs...)
+			c := testConfig(t, e)
+			spec, err := getServiceDefinition(testContext(c), 1, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+			if err != nil {
+				t.Fatalf("getServiceDefinition: %v", err)
+			}
+			if got := spec.TaskTemplate.ContainerSpec.Command; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("command: got %q, want %q", got, tt.want)
+			}
+			if got := spec.TaskTemplate.ContainerSpec.Args; got != nil {
+				t.Errorf("args: got %q, want none", got)
+			}
+		})
+	}
+}
+
+func TestServiceTmpfs(t *testing.T) {
+	tmpfs := func(target string, size int64, mode os.FileMode) mount.Mount {
+		return mount.Mount{Type: mount.TypeTmpfs, Target: target, TmpfsOptions: &mount.TmpfsOptions{SizeBytes: size, Mode: mode}}
+	}
+	tests := []struct {
+		name    string
+		value   string
+		want    []mount.Mount
+		wantErr string
+	}{
+		{name: "target only", value: "/tmp", want: []mount.Mount{tmpfs("/tmp", 0, 0)}},
+		{name: "size", value: "/tmp:size=64m", want: []mount.Mount{tmpfs("/tmp", 64*1024*1024, 0)}},
+		{name: "size in bytes", value: "/tmp:size=4096", want: []mount.Mount{tmpfs("/tmp", 4096, 0)}},
+		{name: "mode", value: "/tmp:mode=1777", want: []mount.Mount{tmpfs("/tmp", 0, 01777)}},
+		{name: "size and mode", value: "/tmp:size=64m:mode=1777", want: []mount.Mount{tmpfs("/tmp", 64*1024*1024, 01777)}},
+		{name: "mode and size", value: "/tmp:mode=700:size=1g", want: []mount.Mount{tmpfs("/tmp", 1024*1024*1024, 0700)}},
+		{name: "two mounts", value: "/tmp:size=64m, /run:mode=755", want: []mount.Mount{tmpfs("/tmp", 64*1024*1024, 0), tmpfs("/run", 0, 0755)}},
+		{name: "relative target", value: "tmp:size=64m", wantErr: "absolute path"},
+		{name: "bad size", value: "/tmp:size=lots", wantErr: "invalid tmpfs size"},
+		{name: "no size", value: "/tmp:size=0", wantErr: "invalid tmpfs size"},
+		{name: "mode not octal", value: "/tmp:mode=999", wantErr: "expected octal"},
+		{name: "unknown option", value: "/tmp:uid=1000", wantErr: "unknown tmpfs option"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := getConfig(baseEnv("SERVICE_TMPFS="+tt.value), false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			if !reflect.DeepEqual(c.Mounts, tt.want) {
+				t.Errorf("got %+v, want %+v", c.Mounts, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkDir(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "image default"},
+		{name: "absolute", value: "/srv/probe", want: "/srv/probe"},
+		{name: "passed as given", value: "/srv/../opt/probe/", want: "/srv/../opt/probe/"},
+		{name: "relative", value: "srv/probe", wantErr: true},
+		{name: "dot", value: ".", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv()
+			if tt.value != "" {
+				e = baseEnv("WORKDIR=" + tt.value)
+			}
+			c, err := getConfig(e, false)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "WORKDIR") {
+					t.Fatalf("got %v, want an error about WORKDIR", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			spec, err := getServiceDefinition(testContext(&c), 1, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+			if err != nil {
+				t.Fatalf("getServiceDefinition: %v", err)
+			}
+			if got := spec.TaskTemplate.ContainerSpec.Dir; got != tt.want {
+				t.Errorf("dir: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvMapFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "composer-envmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		lines   []string
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "renamed",
+			lines: []string{"# composer key: container key", "PING_PORT: PORT", "", "  TEAM :  OWNER  "},
+			want:  []string{"IMAGE=pinger:1.0", "OWNER=net", "PORT=8111", "SERVICE_NAME=pinger", "STACK_NAME=probe"},
+		},
+		{
+			name:  "nothing mapped",
+			lines: []string{"UNUSED: NOWHERE"},
+			want:  []string{"IMAGE=pinger:1.0", "PING_PORT=8111", "SERVICE_NAME=pinger", "STACK_NAME=probe", "TEAM=net"},
+		},
+		{name: "no colon", lines: []string{"PING_PORT: PORT", "TEAM OWNER"}, wantErr: "line 2: expected key: value"},
+		{name: "no container key", lines: []string{"TEAM:"}, wantErr: "line 1: expected key: value"},
+		{name: "no composer key", lines: []string{": OWNER"}, wantErr: "line 1: expected key: value"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("map%d", i))
+			if err := ioutil.WriteFile(path, []byte(strings.Join(tt.lines, "\n")+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			e := baseEnv("PING_PORT=8111", "TEAM=net")
+			c, err := getConfig(baseEnv("ENV_MAP_FILE="+path), false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			if got := e.getContainerEnv(c.EnvMap); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := getConfig(baseEnv("ENV_MAP_FILE="+filepath.Join(dir, "missing")), false); err == nil || !strings.Contains(err.Error(), "ENV_MAP_FILE") {
+		t.Errorf("missing file: got %v, want an error about ENV_MAP_FILE", err)
+	}
+}
+
+func TestExtraHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "unset"},
+		{name: "one", value: "db:10.0.0.3", want: []string{"10.0.0.3 db"}},
+		{name: "several", value: "db:10.0.0.3, cache.internal:10.0.0.4", want: []string{"10.0.0.3 db", "10.0.0.4 cache.internal"}},
+		{name: "ipv6", value: "db:fd00::3", want: []string{"fd00::3 db"}},
+		{name: "no ip", value: "db", wantErr: true},
+		{name: "bad ip", value: "db:10.0.0.300", wantErr: true},
+		{name: "ip first", value: "10.0.0.3:db", wantErr: true},
+		{name: "no host", value: ":10.0.0.3", wantErr: true},
+		{name: "one bad of two", value: "db:10.0.0.3,cache", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv()
+			if tt.value != "" {
+				e = baseEnv("EXTRA_HOSTS=" + tt.value)
+			}
+			c, err := getConfig(e, false)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "EXTRA_HOSTS") {
+					t.Fatalf("got %v, want an error about EXTRA_HOSTS", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			spec, err := getServiceDefinition(testContext(&c), 1, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+			if err != nil {
+				t.Fatalf("getServiceDefinition: %v", err)
+			}
+			// swarm wants "ip hostname", as in /etc/hosts
+			if got := spec.TaskTemplate.ContainerSpec.Hosts; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hosts: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReservations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "composer-reservations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// limits only come from a service configs file
+	limits := filepath.Join(dir, "limits.json")
+	if err := ioutil.WriteFile(limits, []byte(`{"resources": {"Limits": {"NanoCPUs": 1000000000, "MemoryBytes": 268435456}, "Reservations": {"NanoCPUs": 1}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pairs   []string
+		want    *swarm.ResourceRequirements
+		wantErr string
+	}{
+		{name: "unset"},
+		{name: "cpu", pairs: []string{"CPU_RESERVATION=0.25"}, want: &swarm.ResourceRequirements{Reservations: &swarm.Resources{NanoCPUs: 250000000}}},
+		{name: "memory", pairs: []string{"MEMORY_RESERVATION=64m"}, want: &swarm.ResourceRequirements{Reservations: &swarm.Resources{MemoryBytes: 64 * 1024 * 1024}}},
+		{
+			name:  "both",
+			pairs: []string{"CPU_RESERVATION=2", "MEMORY_RESERVATION=1g"},
+			want:  &swarm.ResourceRequirements{Reservations: &swarm.Resources{NanoCPUs: 2000000000, MemoryBytes: 1024 * 1024 * 1024}},
+		},
+		{
+			// and the env var wins over the file's reservation
+			name:  "with limits",
+			pairs: []string{"CPU_RESERVATION=0.5", "MEMORY_RESERVATION=128m", "SERVICE_CONFIGS_FILE=" + limits},
+			want: &swarm.ResourceRequirements{
+				Limits:       &swarm.Resources{NanoCPUs: 1000000000, MemoryBytes: 256 * 1024 * 1024},
+				Reservations: &swarm.Resources{NanoCPUs: 500000000, MemoryBytes: 128 * 1024 * 1024},
+			},
+		},
+		{name: "cpu not a number", pairs: []string{"CPU_RESERVATION=lots"}, wantErr: "CPU_RESERVATION"},
+		{name: "no cpu", pairs: []string{"CPU_RESERVATION=0"}, wantErr: "CPU_RESERVATION"},
+		{name: "negative cpu", pairs: []string{"CPU_RESERVATION=-1"}, wantErr: "CPU_RESERVATION"},
+		{name: "memory unit", pairs: []string{"MEMORY_RESERVATION=64q"}, wantErr: "MEMORY_RESERVATION"},
+		{name: "no memory", pairs: []string{"MEMORY_RESERVATION=0"}, wantErr: "MEMORY_RESERVATION"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv(tt.pairs...)
+			c, err := getConfig(e, false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error about %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			spec, err := getServiceDefinition(testContext(&c), 1, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+			if err != nil {
+				t.Fatalf("getServiceDefinition: %v", err)
+			}
+			if got := spec.TaskTemplate.Resources; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStackNameOverride(t *testing.T) {
+	tests := []struct {
+		name      string
+		override  string
+		wantStack string
+	}{
+		{name: "none", wantStack: "probe"},
+		{name: "override", override: "prod-probe", wantStack: "prod-probe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv()
+			overrideStackName(e, tt.override)
+			c := testConfig(t, e)
+			if c.StackName != tt.wantStack {
+				t.Errorf("config: got stack %q, want %q", c.StackName, tt.wantStack)
+			}
+			network := targetNetwork{id: "id1", name: "net1", key: "net1"}
+			spec, err := getServiceDefinition(testContext(c), 1, network, envs{"id1": e})
+			if err != nil {
+				t.Fatalf("getServiceDefinition: %v", err)
+			}
+			if want := tt.wantStack + "_net1_pinger"; spec.Name != want {
+				t.Errorf("name: got %q, want %q", spec.Name, want)
+			}
+			if spec.Labels[stackLabel] != tt.wantStack || spec.Labels["com.docker.stack.namespace"] != tt.wantStack+"_net1" {
+				t.Errorf("labels: got %v", spec.Labels)
+			}
+			// the service name inside the container is left as it was
+			if got := setAndGetContainerEnv(envs{"id1": e}, network)["SERVICE_NAME"].value; got != "pinger" {
+				t.Errorf("SERVICE_NAME: got %q", got)
+			}
+		})
+	}
+}
+
+func TestServiceConfigsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "composer-configs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	complete := write("complete.json", `{
+		"mounts": [{"Type": "bind", "Source": "/etc/probe", "Target": "/config", "ReadOnly": true}],
+		"resources": {"Limits": {"NanoCPUs": 1000000000}, "Reservations": {"MemoryBytes": 1048576}},
+		"placement": {"Constraints": ["node.labels.tier==probe"]},
+		"labels": {"com.example.team": "net", "`+stackLabel+`": "someone-else"}
+	}`)
+	bind := mount.Mount{Type: mount.TypeBind, Source: "/etc/probe", Target: "/config", ReadOnly: true}
+
+	tests := []struct {
+		name            string
+		pairs           []string
+		wantMounts      []mount.Mount
+		wantResources   *swarm.ResourceRequirements
+		wantConstraints []string
+	}{
+		{
+			name:            "file only",
+			pairs:           []string{"SERVICE_CONFIGS_FILE=" + complete},
+			wantMounts:      []mount.Mount{bind},
+			wantResources:   &swarm.ResourceRequirements{Limits: &swarm.Resources{NanoCPUs: 1000000000}, Reservations: &swarm.Resources{MemoryBytes: 1048576}},
+			wantConstraints: []string{"node.labels.tier==probe"},
+		},
+		{
+			// lists are added to, after what the env vars gave - and where both set something, the env var wins
+			name:  "with env vars",
+			pairs: []string{"SERVICE_CONFIGS_FILE=" + complete, "SERVICE_TMPFS=/tmp", "MEMORY_RESERVATION=2m", "ENGINE_LABELS=zone=a"},
+			wantMounts: []mount.Mount{
+				{Type: mount.TypeTmpfs, Target: "/tmp", TmpfsOptions: &mount.TmpfsOptions{}},
+				bind,
+			},
+			wantResources:   &swarm.ResourceRequirements{Limits: &swarm.Resources{NanoCPUs: 1000000000}, Reservations: &swarm.Resources{MemoryBytes: 2 * 1048576}},
+			wantConstraints: []string{"engine.labels.zone==a", "node.labels.tier==probe"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv(tt.pairs...)
+			c := testConfig(t, e)
+			spec, err := getServiceDefinition(testContext(c), 1, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+			if err != nil {
+				t.Fatalf("getServiceDefinition: %v", err)
+			}
+			if got := spec.TaskTemplate.ContainerSpec.Mounts; !reflect.DeepEqual(got, tt.wantMounts) {
+				t.Errorf("mounts: got %+v, want %+v", got, tt.wantMounts)
+			}
+			if got := spec.TaskTemplate.Resources; !reflect.DeepEqual(got, tt.wantResources) {
+				t.Errorf("resources: got %+v, want %+v", got, tt.wantResources)
+			}
+			if got := spec.TaskTemplate.Placement; got == nil || !reflect.DeepEqual(got.Constraints, tt.wantConstraints) {
+				t.Errorf("placement: got %+v, want %v", got, tt.wantConstraints)
+			}
+			// extra labels are taken, but never one of ours
+			if spec.Labels["com.example.team"] != "net" || spec.Labels[stackLabel] != "probe" {
+				t.Errorf("labels: got %v", spec.Labels)
+			}
+			// the file's part of the spec is hashed like the rest
+			if hash, _ := getSpecHash(spec); spec.Labels[specHashLabel] != hash {
+				t.Errorf("spec hash label %q, want %q", spec.Labels[specHashLabel], hash)
+			}
+		})
+	}
+
+	for name, path := range map[string]string{
+		"missing":  filepath.Join(dir, "missing.json"),
+		"not json": write("bad.json", "mounts: []"),
+	} {
+		if _, err := getConfig(baseEnv("SERVICE_CONFIGS_FILE="+path), false); err == nil || !strings.Contains(err.Error(), "SERVICE_CONFIGS_FILE") {
+			t.Errorf("%s: got %v, want an error about SERVICE_CONFIGS_FILE", name, err)
+		}
+	}
+}
+
+func TestServiceNamedVolumes(t *testing.T) {
+	volume := func(source, target string) mount.Mount {
+		return mount.Mount{Type: mount.TypeVolume, Source: source, Target: target}
+	}
+	tests := []struct {
+		name    string
+		pairs   []string
+		want    []mount.Mount
+		wantErr string
+	}{
+		{name: "one", pairs: []string{"SERVICE_NAMED_VOLUMES=probe-data:/data"}, want: []mount.Mount{volume("probe-data", "/data")}},
+		{name: "two", pairs: []string{"SERVICE_NAMED_VOLUMES=probe-data:/data, probe-cache:/var/cache/probe"}, want: []mount.Mount{volume("probe-data", "/data"), volume("probe-cache", "/var/cache/probe")}},
+		{
+			// added after any tmpfs mounts
+			name:  "with tmpfs",
+			pairs: []string{"SERVICE_NAMED_VOLUMES=probe-data:/data", "SERVICE_TMPFS=/tmp"},
+			want:  []mount.Mount{{Type: mount.TypeTmpfs, Target: "/tmp", TmpfsOptions: &mount.TmpfsOptions{}}, volume("probe-data", "/data")},
+		},
+		{name: "relative target", pairs: []string{"SERVICE_NAMED_VOLUMES=probe-data:data"}, wantErr: "absolute path"},
+		{name: "no target", pairs: []string{"SERVICE_NAMED_VOLUMES=probe-data"}, wantErr: "expected volumeName:targetPath"},
+		{name: "no volume", pairs: []string{"SERVICE_NAMED_VOLUMES=:/data"}, wantErr: "expected volumeName:targetPath"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv(tt.pairs...)
+			c, err := getConfig(e, false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "SERVICE_NAMED_VOLUMES") {
+					t.Fatalf("got %v, want an error about SERVICE_NAMED_VOLUMES containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			spec, err := getServiceDefinition(testContext(&c), 1, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+			if err != nil {
+				t.Fatalf("getServiceDefinition: %v", err)
+			}
+			if got := spec.TaskTemplate.ContainerSpec.Mounts; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailureSummary(t *testing.T) {
+	tests := []struct {
+		name   string
+		report DeployReport
+		want   string
+	}{
+		{name: "nothing failed", report: DeployReport{}, want: ""},
+		{
+			name:   "build failures only",
+			report: DeployReport{FailedNetworks: []string{"net1", "net2"}},
+			want:   "2 of 3 networks could not be built: net1, net2",
+		},
+		{
+			name:   "apply failures only",
+			report: DeployReport{Failed: []string{"probe_net1_pinger"}},
+			want:   "1 of 2 services failed: probe_net1_pinger",
+		},
+		{
+			name:   "both",
+			report: DeployReport{FailedNetworks: []string{"net3"}, Failed: []string{"probe_net1_pinger"}},
+			want:   "1 of 3 networks could not be built: net3; 1 of 2 services failed: probe_net1_pinger",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.report.failureSummary(3, 2); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// setenv sets a process env var for the length of a test
+func setenv(t *testing.T, key, value string) func() {
+	t.Helper()
+	old, present := os.LookupEnv(key)
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if present {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// writeTestCerts drops a self-signed ca.pem, cert.pem and key.pem into dir, laid out as the docker cli expects
+func writeTestCerts(t *testing.T, dir string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "composer-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	files := map[string][]byte{
+		"ca.pem":   cert,
+		"cert.pem": cert,
+		"key.pem":  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDockerTransportTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "composer-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCerts(t, dir)
+	defer setenv(t, "DOCKER_CERT_PATH", dir)()
+
+	c := testConfig(t, baseEnv())
+	ctx := testContext(c)
+	// not the host's socket, whose permissions are no part of this
+	unixSock := "unix://" + filepath.Join(dir, "docker.sock")
+	tests := []struct {
+		name    string
+		sock    string
+		verify  string
+		wantTLS bool
+		wantErr string
+	}{
+		{name: "tcp with tls", sock: "tcp://10.0.0.1:2376", verify: "1", wantTLS: true},
+		{name: "tcp without tls", sock: "tcp://10.0.0.1:2375"},
+		{name: "unix without tls", sock: unixSock},
+		{name: "unix with tls", sock: unixSock, verify: "1", wantErr: "only supported with a tcp://"},
+		{name: "npipe with tls", sock: "npipe:////./pipe/docker_engine", verify: "1", wantErr: "only supported with a tcp://"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setenv(t, "DOCKER_TLS_VERIFY", tt.verify)()
+			transport, err := newDockerTransport(ctx, tt.sock)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newDockerTransport: %v", err)
+			}
+			if got := transport.TLSClientConfig != nil; got != tt.wantTLS {
+				t.Fatalf("tls configured: got %v, want %v", got, tt.wantTLS)
+			}
+			if tt.wantTLS && (len(transport.TLSClientConfig.Certificates) != 1 || transport.TLSClientConfig.RootCAs == nil) {
+				t.Errorf("certs from %s not loaded", dir)
+			}
+		})
+	}
+}
+
+func TestDockerTransportMissingCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "composer-certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer setenv(t, "DOCKER_CERT_PATH", dir)()
+	defer setenv(t, "DOCKER_TLS_VERIFY", "1")()
+
+	c := testConfig(t, baseEnv())
+	if _, err := newDockerTransport(testContext(c), "tcp://10.0.0.1:2376"); err == nil {
+		t.Fatal("expected an error for an empty cert dir")
+	}
+}
+
+func TestGenerateNetworkName(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   string
+		suffix string
+		want   string
+	}{
+		{name: "plain", base: "probe", suffix: "net1", want: "probe_net1"},
+		{name: "no suffix", base: "probe", want: "probe"},
+		{name: "spaces", base: " my probe ", suffix: "front end", want: "my-probe_front-end"},
+		{name: "case kept", base: "Probe", suffix: "NetOne", want: "Probe_NetOne"},
+		{name: "dots replaced", base: "probe", suffix: "net.one", want: "probe_net-one"},
+		{name: "leading hyphens", base: "--probe", suffix: "net1", want: "probe_net1"},
+		{name: "trailing hyphens", base: "probe", suffix: "net1--", want: "probe_net1"},
+		{name: "too long", base: strings.Repeat("a", 60), suffix: "net1", want: strings.Repeat("a", 60) + "_ne"},
+		{name: "cut at separator", base: strings.Repeat("a", 62), suffix: "net1", want: strings.Repeat("a", 62)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := generateNetworkName(tt.base, tt.suffix)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if len(got) > maxServiceNameLength {
+				t.Errorf("%q is longer than %d", got, maxServiceNameLength)
+			}
+		})
+	}
+}
+
+func TestServiceSpecNameLength(t *testing.T) {
+	e := baseEnv("STACK_NAME=" + strings.Repeat("Stack", 20))
+	network := targetNetwork{id: "id1", name: "net1", key: "net1"}
+	got := setAndGetContainerEnv(envs{"id1": e}, network)["SERVICE_SPEC_NAME"].value
+	if len(got) > maxServiceNameLength {
+		t.Errorf("%q is longer than %d", got, maxServiceNameLength)
+	}
+	if !strings.HasPrefix(got, "StackStack") || !strings.HasSuffix(got, "_pinger") {
+		t.Errorf("got %q, want the stack prefix and service name kept", got)
+	}
+}
+
+func TestForceNetworks(t *testing.T) {
+	fake := newFakeDocker()
+	fake.networks = []types.NetworkResource{
+		{ID: "net1-id", Name: "net1", Driver: "overlay", Scope: "swarm"},
+		{ID: "macvlan1-id", Name: "macvlan1", Driver: "macvlan", Scope: "swarm"},
+		{ID: "bridge1-id", Name: "bridge1", Driver: "bridge", Scope: "local"},
+	}
+	tests := []struct {
+		name  string
+		pairs []string
+		want  []string
+	}{
+		{name: "overlay only", want: []string{"net1"}},
+		{name: "forced macvlan", pairs: []string{"FORCE_NETWORKS=macvlan1"}, want: []string{"macvlan1", "net1"}},
+		{name: "forced twice over", pairs: []string{"FORCE_NETWORKS=macvlan1,bridge1"}, want: []string{"bridge1", "macvlan1", "net1"}},
+		{name: "forced, but avoided", pairs: []string{"FORCE_NETWORKS=macvlan1", "AVOID_NETWORKS=macvlan1"}, want: []string{"net1"}},
+		{name: "forced, case differs", pairs: []string{"FORCE_NETWORKS=MACVLAN1"}, want: []string{"net1"}},
+		{name: "forced, case folded", pairs: []string{"FORCE_NETWORKS=MACVLAN1", "CASE_INSENSITIVE_NAMES=1"}, want: []string{"macvlan1", "net1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv(tt.pairs...)
+			c := testConfig(t, e)
+			networks := getNetworkList(testContext(c), fake)
+			// and each one ends up with a service of its own
+			worklist, err := BuildWorklist(networks, []string{"node1", "node2"}, c, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, work := range worklist {
+				got = append(got, getNetworkNames(networks)[getTargetNetwork(work)])
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got services on %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttachableOnly(t *testing.T) {
+	fake := newFakeDocker()
+	fake.networks = []types.NetworkResource{
+		{ID: "shared-id", Name: "shared", Driver: "overlay", Scope: "swarm", Attachable: true},
+		{ID: "services-id", Name: "services", Driver: "overlay", Scope: "swarm"},
+		{ID: "tools-id", Name: "tools", Driver: "overlay", Scope: "swarm", Attachable: true},
+	}
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "unset", want: []string{"shared", "services", "tools"}},
+		{name: "off", value: "false", want: []string{"shared", "services", "tools"}},
+		{name: "on", value: "true", want: []string{"shared", "tools"}},
+		{name: "on, as 1", value: "1", want: []string{"shared", "tools"}},
+		{name: "not a bool", value: "yes", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv()
+			if tt.value != "" {
+				e = baseEnv("NETWORK_ATTACHABLE_ONLY=" + tt.value)
+			}
+			c, err := getConfig(e, false)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "NETWORK_ATTACHABLE_ONLY") {
+					t.Fatalf("got %v, want an error about NETWORK_ATTACHABLE_ONLY", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			networks, err := paginateNetworks(testContext(&c), fake, networkPageSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, network := range networks {
+				got = append(got, network.name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworkSkipReasonsLogged(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	fake := newFakeDocker()
+	fake.networks = []types.NetworkResource{
+		{ID: "front-id", Name: "front", Driver: "overlay", Scope: "swarm", Attachable: true, Labels: map[string]string{"com.docker.stack.namespace": "shop"}},
+		{ID: "bridge-id", Name: "bridge", Driver: "bridge", Scope: "local"},
+		{ID: "ingress-id", Name: "ingress", Driver: "overlay", Scope: "swarm", Attachable: true, Labels: map[string]string{"com.docker.stack.namespace": "shop"}},
+		{ID: "blog-id", Name: "blog", Driver: "overlay", Scope: "swarm", Attachable: true, Labels: map[string]string{"com.docker.stack.namespace": "blog"}},
+		{ID: "sealed-id", Name: "sealed", Driver: "overlay", Scope: "swarm", Labels: map[string]string{"com.docker.stack.namespace": "shop"}},
+		{ID: "busy-id", Name: "busy", Driver: "overlay", Scope: "swarm", Attachable: true, Labels: map[string]string{"com.docker.stack.namespace": "shop"}},
+	}
+	fake.addService(attachedSpec("web", "", "busy-id"))
+	c := testConfig(t, baseEnv("DEBUG=1", "TARGET_STACK=shop", "NETWORK_ATTACHABLE_ONLY=1", "NETWORK_MAX_SERVICES=1"))
+	networks := getNetworkList(testContext(c), fake)
+	if len(networks) != 1 || networks[0].name != "front" {
+		t.Fatalf("got %+v, want front only", networks)
+	}
+
+	for _, want := range []string{
+		"debug: skipping network bridge (bridge-id): driver",
+		"debug: skipping network ingress (ingress-id): avoid",
+		"debug: skipping network blog (blog-id): not-included",
+		"debug: skipping network sealed (sealed-id): not-attachable",
+		"debug: skipping network busy (busy-id): full",
+		"using networks: front\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("no %q in:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "skipping network front") {
+		t.Errorf("front logged as skipped:\n%s", out.String())
+	}
+
+	// and without DEBUG, only the networks used are logged
+	out.Reset()
+	c.Debug = false
+	getNetworkList(testContext(c), fake)
+	if strings.Contains(out.String(), "skipping") || !strings.Contains(out.String(), "using networks: front") {
+		t.Errorf("got:\n%s", out.String())
+	}
+}
+
+func TestNetworkSortOrder(t *testing.T) {
+	base := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	created := func(name string, days int) types.NetworkResource {
+		return types.NetworkResource{ID: name + "-id", Name: name, Driver: "overlay", Scope: "swarm", Created: base.AddDate(0, 0, days)}
+	}
+	fake := newFakeDocker()
+	// as the api might return them
+	fake.networks = []types.NetworkResource{created("charlie", 1), created("alpha", 3), created("delta", 0), created("bravo", 1)}
+	tests := []struct {
+		name    string
+		order   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "default", want: []string{"alpha", "bravo", "charlie", "delta"}},
+		{name: "name", order: "name", want: []string{"alpha", "bravo", "charlie", "delta"}},
+		// oldest first, and by name where two were created together
+		{name: "created", order: "created", want: []string{"delta", "bravo", "charlie", "alpha"}},
+		{name: "unknown", order: "newest", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv()
+			if tt.order != "" {
+				e = baseEnv("NETWORK_SORT_ORDER=" + tt.order)
+			}
+			c, err := getConfig(e, false)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "NETWORK_SORT_ORDER") {
+					t.Fatalf("got %v, want an error about NETWORK_SORT_ORDER", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			// and the same order however the api lists them
+			for pass := 0; pass < 2; pass++ {
+				got := []string{}
+				for _, network := range getNetworkList(testContext(&c), fake) {
+					got = append(got, network.name)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("pass %d: got %v, want %v", pass, got, tt.want)
+				}
+				sort.Slice(fake.networks, func(i, j int) bool { return fake.networks[i].Name > fake.networks[j].Name })
+			}
+		})
+	}
+}
+
+func TestListFilters(t *testing.T) {
+	fake := newFakeDocker()
+	fake.networks = []types.NetworkResource{{ID: "net1-id", Name: "net1", Driver: "overlay", Scope: "swarm"}}
+	fake.nodes = []swarm.Node{testNode("node1", false, false)}
+	tests := []struct {
+		name       string
+		pairs      []string
+		wantDriver []string
+		wantLabel  []string
+	}{
+		{name: "defaults", wantDriver: []string{"overlay"}},
+		{name: "target stack", pairs: []string{"TARGET_STACK=shop"}, wantDriver: []string{"overlay"}, wantLabel: []string{"com.docker.stack.namespace=shop"}},
+		// these have to be done client side
+		{name: "forced networks", pairs: []string{"FORCE_NETWORKS=macvlan1"}},
+		{name: "target stack, folded", pairs: []string{"TARGET_STACK=shop", "CASE_INSENSITIVE_NAMES=1"}, wantDriver: []string{"overlay"}},
+	}
+	// Get gives back an empty, not nil, slice for a field that isn't there
+	same := func(got, want []string) bool {
+		return len(got) == len(want) && (len(want) == 0 || reflect.DeepEqual(got, want))
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, baseEnv(tt.pairs...))
+			ctx := testContext(c)
+			if _, err := paginateNetworks(ctx, fake, networkPageSize); err != nil {
+				t.Fatal(err)
+			}
+			if got := fake.networkFilters.Get("driver"); !same(got, tt.wantDriver) {
+				t.Errorf("network driver filter: got %v, want %v", got, tt.wantDriver)
+			}
+			if got := fake.networkFilters.Get("label"); !same(got, tt.wantLabel) {
+				t.Errorf("network label filter: got %v, want %v", got, tt.wantLabel)
+			}
+
+			// every node is fetched, so the ones left out can be counted
+			getNodeList(ctx, fake)
+			if n := fake.nodeFilters.Len(); n != 0 {
+				t.Errorf("node list: got %d filters, want none", n)
+			}
+
+			if _, err := ServiceListFilter(ctx, fake, c.StackName); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := fake.serviceFilters.Get("label"), []string{stackLabel + "=probe"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("service label filter: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTargetStack(t *testing.T) {
+	stackNetwork := func(name, stack, driver string) types.NetworkResource {
+		network := types.NetworkResource{ID: name + "-id", Name: name, Driver: driver, Scope: "swarm"}
+		if stack != "" {
+			network.Labels = map[string]string{"com.docker.stack.namespace": stack}
+		}
+		return network
+	}
+	fake := newFakeDocker()
+	fake.networks = []types.NetworkResource{
+		stackNetwork("shop_front", "shop", "overlay"),
+		stackNetwork("shop_back", "shop", "overlay"),
+		stackNetwork("shop_local", "shop", "bridge"),
+		stackNetwork("blog_front", "blog", "overlay"),
+		stackNetwork("loose", "", "overlay"),
+	}
+	tests := []struct {
+		name  string
+		pairs []string
+		want  []string
+	}{
+		{name: "not set", want: []string{"shop_front", "shop_back", "blog_front", "loose"}},
+		{name: "one stack", pairs: []string{"TARGET_STACK=shop"}, want: []string{"shop_front", "shop_back"}},
+		{name: "the other stack", pairs: []string{"TARGET_STACK=blog"}, want: []string{"blog_front"}},
+		{name: "avoid still applies", pairs: []string{"TARGET_STACK=shop", "AVOID_NETWORKS=shop_back"}, want: []string{"shop_front"}},
+		{name: "forced from another stack", pairs: []string{"TARGET_STACK=shop", "FORCE_NETWORKS=blog_front"}, want: []string{"shop_front", "shop_back", "blog_front"}},
+		{name: "no such stack", pairs: []string{"TARGET_STACK=wiki"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, baseEnv(tt.pairs...))
+			networks, err := paginateNetworks(testContext(c), fake, networkPageSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, network := range networks {
+				got = append(got, network.name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the engine is asked to do the filtering too, as long as it can do so exactly
+	filterTests := []struct {
+		name      string
+		pairs     []string
+		wantLabel []string
+	}{
+		{name: "exact", pairs: []string{"TARGET_STACK=shop"}, wantLabel: []string{"com.docker.stack.namespace=shop"}},
+		{name: "folded", pairs: []string{"TARGET_STACK=shop", "CASE_INSENSITIVE_NAMES=1"}},
+		{name: "forced", pairs: []string{"TARGET_STACK=shop", "FORCE_NETWORKS=blog_front"}},
+	}
+	for _, tt := range filterTests {
+		t.Run("filter "+tt.name, func(t *testing.T) {
+			args := getNetworkFilters(testConfig(t, baseEnv(tt.pairs...)))
+			if got := args.Get("label"); len(got) != len(tt.wantLabel) || (len(got) > 0 && !reflect.DeepEqual(got, tt.wantLabel)) {
+				t.Errorf("label filter: got %v, want %v", got, tt.wantLabel)
+			}
+		})
+	}
+
+	// and a failed list is handed back, not mistaken for there being no networks
+	fake.networkErr = errors.New("Error response from daemon: network list failed")
+	c := testConfig(t, baseEnv("TARGET_STACK=shop"))
+	if networks, err := paginateNetworks(testContext(c), fake, networkPageSize); err != fake.networkErr || networks != nil {
+		t.Errorf("got %v, %v, want the daemon's error", networks, err)
+	}
+}
+
+func BenchmarkPaginateNetworks(b *testing.B) {
+	names := make([]string, 10000)
+	for i := range names {
+		names[i] = fmt.Sprintf("net%d", i)
+	}
+	fake := newFakeDocker()
+	fake.networks = make([]types.NetworkResource, len(names))
+	for i, name := range names {
+		fake.networks[i] = types.NetworkResource{
+			ID:         fmt.Sprintf("%s-id", name),
+			Name:       name,
+			Driver:     "overlay",
+			Scope:      "swarm",
+			Containers: map[string]types.EndpointResource{"c1": {Name: "c1"}, "c2": {Name: "c2"}},
+			Options:    map[string]string{"com.docker.network.driver.overlay.vxlanid_list": "4097"},
+		}
+	}
+	ctx := testContext(testConfig(b, baseEnv()))
+	for _, pageSize := range []int{100, networkPageSize, len(names)} {
+		b.Run(fmt.Sprintf("page=%d", pageSize), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				networks, err := paginateNetworks(ctx, fake, pageSize)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(networks) != len(names) {
+					b.Fatalf("got %d networks, want %d", len(networks), len(names))
+				}
+			}
+		})
+	}
+}
+
+// daemonReply answers every request with status and, if set, a json error body as the daemon sends them
+func daemonReply(status int, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if message != "" {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(status)
+		if message != "" {
+			fmt.Fprintf(w, `{"message":%q}`, message)
+		}
+	}
+}
+
+func TestClassifyErrorStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		message    string
+		wantRetry  bool
+		wantInText string
+	}{
+		{name: "503 json", status: http.StatusServiceUnavailable, message: "swarm is busy", wantRetry: true, wantInText: "swarm is busy"},
+		{name: "503 empty", status: http.StatusServiceUnavailable, wantRetry: true, wantInText: "Service Unavailable"},
+		{name: "429 json", status: http.StatusTooManyRequests, message: "slow down", wantRetry: true, wantInText: "slow down"},
+		{name: "404 json", status: http.StatusNotFound, message: "no such image", wantInText: "no such image"},
+		{name: "500 json", status: http.StatusInternalServerError, message: "Service Unavailable", wantInText: "Service Unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(daemonReply(tt.status, tt.message))
+			defer srv.Close()
+			cli, err := newAPIClient("tcp://"+srv.Listener.Addr().String(), &http.Transport{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = cli.ServiceCreate(context.Background(), swarm.ServiceSpec{}, types.ServiceCreateOptions{})
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			err = classifyError(err)
+			if got := isRetryable(err); got != tt.wantRetry {
+				t.Fatalf("retryable: got %v, want %v (%v)", got, tt.wantRetry, err)
+			}
+			if !strings.Contains(err.Error(), tt.wantInText) {
+				t.Errorf("got %q, want it to contain %q", err.Error(), tt.wantInText)
+			}
+			var retryable retryableError
+			if tt.wantRetry && (!errors.As(err, &retryable) || retryable.status != tt.status) {
+				t.Errorf("status: got %d, want %d", retryable.status, tt.status)
+			}
+		})
+	}
+}
+
+func TestCreateServiceRetriesUnavailable(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			daemonReply(http.StatusServiceUnavailable, "swarm is busy")(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"ID":"svc1"}`)
+	}))
+	defer srv.Close()
+	cli, err := newAPIClient("tcp://"+srv.Listener.Addr().String(), &http.Transport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig(t, baseEnv("STARTUP_RETRIES=5", "STARTUP_RETRIES_DELAY_SECONDS=0"))
+	if err := createService(testContext(c), cli, swarm.ServiceSpec{}); err != nil {
+		t.Fatalf("createService: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+}
+
+func replicatedSpec(name string, replicas uint64) swarm.ServiceSpec {
+	spec := swarm.ServiceSpec{Mode: swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}}}
+	spec.Name = name
+	return spec
+}
+
+func TestReconcileOnly(t *testing.T) {
+	var events int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&events, 1)
+	}))
+	defer hook.Close()
+
+	fake := newFakeDocker()
+	fake.addService(replicatedSpec("same", 2))
+	fake.addService(replicatedSpec("scaled", 1))
+	fake.addService(replicatedSpec("deferred", 1))
+	worklist := []swarm.ServiceSpec{
+		replicatedSpec("same", 2),
+		replicatedSpec("missing", 2),
+		replicatedSpec("scaled", 2),
+		replicatedSpec("deferred", 2),
+	}
+	c := testConfig(t, baseEnv("RECONCILE_ONLY=1", "MAX_CHANGES_PER_CYCLE=1", "EVENT_WEBHOOK_URL="+hook.URL))
+	report := DeployReport{}
+	executeWorklist(testContext(c), fake, worklist, nil, &report)
+
+	// a service already at the right count is skipped - it is no change, and so doesn't use up MAX_CHANGES_PER_CYCLE
+	want := DeployReport{Updated: []string{"scaled"}, Skipped: []string{"same", "missing"}, Deferred: []string{"deferred"}}
+	if !reflect.DeepEqual(report.Updated, want.Updated) || !reflect.DeepEqual(report.Skipped, want.Skipped) ||
+		!reflect.DeepEqual(report.Deferred, want.Deferred) || len(report.Created) != 0 || len(report.Failed) != 0 {
+		t.Errorf("got %+v, want %+v", report, want)
+	}
+	if len(fake.created) != 0 {
+		t.Errorf("created %v with RECONCILE_ONLY set", fake.created)
+	}
+	if !reflect.DeepEqual(fake.updated, []string{"scaled"}) {
+		t.Errorf("updated %v, want [scaled]", fake.updated)
+	}
+	if got := replicasOf(fake.services["scaled"].Spec); got != 2 {
+		t.Errorf("scaled has %d replicas, want 2", got)
+	}
+	if events != 1 {
+		t.Errorf("got %d webhook events, want 1", events)
+	}
+}
+
+func TestDumpConfigRedacts(t *testing.T) {
+	e := baseEnv(
+		"EVENT_WEBHOOK_URL=https://hooks.example.com/T000/B000/xyzzy",
+		"PING_TARGETS=10.1.2.3,db.internal",
+		"PRE_DEPLOY_HOOK=/usr/local/bin/notify --key plugh",
+		"API_TOKEN=fee-fi-fo",
+		"REDACT_KEYS=EVENT_WEBHOOK_URL,PING_TARGETS",
+	)
+	c := testConfig(t, e)
+	var out bytes.Buffer
+	if err := dumpConfig(&out, *c, e); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"xyzzy", "10.1.2.3", "db.internal", "fee-fi-fo"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("%q not redacted:\n%s", secret, out.String())
+		}
+	}
+	// not in REDACT_KEYS, so left alone
+	if !strings.Contains(out.String(), "plugh") {
+		t.Errorf("PRE_DEPLOY_HOOK redacted without being asked to:\n%s", out.String())
+	}
+}
+
+func TestConfigFieldsExist(t *testing.T) {
+	// a renamed config field would otherwise quietly stop being redacted
+	fields := reflect.TypeOf(config{})
+	for key, names := range configFields {
+		for _, name := range names {
+			if _, found := fields.FieldByName(name); !found {
+				t.Errorf("%s maps to %s, which config does not have", key, name)
+			}
+		}
+	}
+}
+
+func TestConnectionTimeouts(t *testing.T) {
+	// whatever docker setup the machine running the tests has is no part of this
+	defer setenv(t, "DOCKER_TLS_VERIFY", "")()
+	defer setenv(t, "DOCKER_CERT_PATH", "")()
+	dir, err := ioutil.TempDir("", "composer-sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	unixSock := "unix://" + filepath.Join(dir, "docker.sock")
+
+	tests := []struct {
+		name        string
+		pairs       []string
+		wantConnect time.Duration
+		wantIdle    time.Duration
+		wantErr     bool
+	}{
+		{name: "defaults", wantConnect: time.Second, wantIdle: time.Second},
+		{name: "zero", pairs: []string{"CONNECTION_TIMEOUT_SECONDS=0", "IDLE_CONNECTION_TIMEOUT_SECONDS=0"}},
+		{
+			name:        "upper bounds",
+			pairs:       []string{"CONNECTION_TIMEOUT_SECONDS=300", "IDLE_CONNECTION_TIMEOUT_SECONDS=3600"},
+			wantConnect: 300 * time.Second,
+			wantIdle:    time.Hour,
+		},
+		{name: "connect too long", pairs: []string{"CONNECTION_TIMEOUT_SECONDS=301"}, wantErr: true},
+		{name: "idle too long", pairs: []string{"IDLE_CONNECTION_TIMEOUT_SECONDS=3601"}, wantErr: true},
+		{name: "negative", pairs: []string{"CONNECTION_TIMEOUT_SECONDS=-1"}, wantErr: true},
+		{name: "not a number", pairs: []string{"IDLE_CONNECTION_TIMEOUT_SECONDS=1s"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := getConfig(baseEnv(tt.pairs...), false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			if c.ConnectionTimeout != tt.wantConnect {
+				t.Errorf("connection timeout: got %s, want %s", c.ConnectionTimeout, tt.wantConnect)
+			}
+			for _, sock := range []string{"tcp://10.0.0.1:2375", unixSock} {
+				transport, err := newDockerTransport(testContext(&c), sock)
+				if err != nil {
+					t.Fatalf("newDockerTransport(%s): %v", sock, err)
+				}
+				if transport.IdleConnTimeout != tt.wantIdle {
+					t.Errorf("%s idle timeout: got %s, want %s", sock, transport.IdleConnTimeout, tt.wantIdle)
+				}
+				if transport.DialContext == nil {
+					t.Errorf("%s: no dialer set", sock)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectionPoolLimits(t *testing.T) {
+	defer setenv(t, "DOCKER_TLS_VERIFY", "")()
+	defer setenv(t, "DOCKER_CERT_PATH", "")()
+	dir, err := ioutil.TempDir("", "composer-sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	unixSock := "unix://" + filepath.Join(dir, "docker.sock")
+
+	tests := []struct {
+		name        string
+		pairs       []string
+		wantIdle    int
+		wantPerHost int
+		wantErr     string
+	}{
+		// go's own defaults
+		{name: "defaults"},
+		{name: "both", pairs: []string{"MAX_IDLE_CONNS=4", "MAX_CONNS_PER_HOST=16"}, wantIdle: 4, wantPerHost: 16},
+		{name: "idle only", pairs: []string{"MAX_IDLE_CONNS=2"}, wantIdle: 2},
+		{name: "zero", pairs: []string{"MAX_IDLE_CONNS=0", "MAX_CONNS_PER_HOST=0"}},
+		{name: "negative idle", pairs: []string{"MAX_IDLE_CONNS=-1"}, wantErr: "MAX_IDLE_CONNS"},
+		{name: "negative per host", pairs: []string{"MAX_CONNS_PER_HOST=-4"}, wantErr: "MAX_CONNS_PER_HOST"},
+		{name: "not a number", pairs: []string{"MAX_CONNS_PER_HOST=lots"}, wantErr: "MAX_CONNS_PER_HOST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := getConfig(baseEnv(tt.pairs...), false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error about %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			for _, sock := range []string{"tcp://10.0.0.1:2375", unixSock} {
+				transport, err := newDockerTransport(testContext(&c), sock)
+				if err != nil {
+					t.Fatalf("newDockerTransport(%s): %v", sock, err)
+				}
+				if transport.MaxIdleConns != tt.wantIdle || transport.MaxConnsPerHost != tt.wantPerHost {
+					t.Errorf("%s: got %d idle, %d per host, want %d, %d", sock, transport.MaxIdleConns, transport.MaxConnsPerHost, tt.wantIdle, tt.wantPerHost)
+				}
+			}
+		})
+	}
+}
+
+// fingerprintSpec builds the spec composer would deploy for net1
+func fingerprintSpec(t *testing.T) swarm.ServiceSpec {
+	t.Helper()
+	e := baseEnv("CONTAINER_LABELS=team=net,tier=probe", "PING_TARGETS=10.0.0.1,10.0.0.2", "EXTRA_HOSTS=db:10.0.0.3", "A=1", "B=2")
+	c := testConfig(t, e)
+	spec, err := getServiceDefinition(testContext(c), 3, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// daemonRewrite makes the changes the daemon makes to a spec on its own
+func daemonRewrite(spec *swarm.ServiceSpec) {
+	spec.TaskTemplate.ContainerSpec.Image += "@sha256:" + strings.Repeat("ab", 32)
+	spec.TaskTemplate.Networks = append(spec.TaskTemplate.Networks, spec.Networks...)
+	spec.Networks = nil
+	spec.TaskTemplate.Resources = &swarm.ResourceRequirements{}
+	spec.UpdateConfig = &swarm.UpdateConfig{Parallelism: 1, FailureAction: "pause"}
+	spec.EndpointSpec = &swarm.EndpointSpec{Mode: swarm.ResolutionModeVIP}
+}
+
+func TestComposerFingerprint(t *testing.T) {
+	want := fingerprintSpec(t).Labels[fingerprintLabel]
+	if want == "" {
+		t.Fatal("no fingerprint label set")
+	}
+	tests := []struct {
+		name   string
+		change func(*swarm.ServiceSpec)
+		same   bool
+	}{
+		{name: "another run", change: func(*swarm.ServiceSpec) {}, same: true},
+		{name: "daemon rewrites", change: daemonRewrite, same: true},
+		{name: "env changed", change: func(s *swarm.ServiceSpec) {
+			s.TaskTemplate.ContainerSpec.Env = append(s.TaskTemplate.ContainerSpec.Env, "DEBUG=1")
+		}},
+		{name: "scaled", change: func(s *swarm.ServiceSpec) {
+			replicas := uint64(9)
+			s.Mode.Replicated.Replicas = &replicas
+		}},
+		{name: "image changed", change: func(s *swarm.ServiceSpec) { s.TaskTemplate.ContainerSpec.Image = "pinger:2.0" }},
+		{name: "label added", change: func(s *swarm.ServiceSpec) { s.Labels["owner"] = "someone" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := fingerprintSpec(t)
+			tt.change(&spec)
+			if got := composerFingerprint(spec); (got == want) != tt.same {
+				t.Errorf("fingerprint %s, deployed with %s - want same: %v", got, want, tt.same)
+			}
+		})
+	}
+}
+
+func TestUpdateServiceOutOfBand(t *testing.T) {
+	tests := []struct {
+		name        string
+		change      func(*swarm.ServiceSpec)
+		wantUpdated bool
+	}{
+		{name: "untouched", change: daemonRewrite},
+		{name: "changed by hand", change: func(s *swarm.ServiceSpec) {
+			daemonRewrite(s)
+			s.TaskTemplate.ContainerSpec.Env = []string{"PING_TARGETS=elsewhere"}
+		}, wantUpdated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			running := fingerprintSpec(t)
+			tt.change(&running)
+			fake := newFakeDocker()
+			fake.addService(running)
+			c := testConfig(t, baseEnv())
+			updated, err := updateService(testContext(c), fake, fingerprintSpec(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated != tt.wantUpdated || len(fake.updated) > 0 != tt.wantUpdated {
+				t.Errorf("updated: got %v (%v), want %v", updated, fake.updated, tt.wantUpdated)
+			}
+		})
+	}
+}
+
+func TestDockerSock(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: defaultDockerSocket},
+		{name: "custom unix path", value: "unix:///run/user/1000/docker.sock", want: "unix:///run/user/1000/docker.sock"},
+		{name: "named pipe", value: "npipe:////./pipe/docker_engine", want: "npipe:////./pipe/docker_engine"},
+		{name: "tcp", value: "tcp://10.0.0.1:2376", want: "tcp://10.0.0.1:2376"},
+		{name: "bare path", value: "/var/run/docker.sock", wantErr: true},
+		{name: "invalid scheme", value: "http://10.0.0.1:2375", wantErr: true},
+		{name: "no path", value: "unix://", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := []string{"STACK_NAME=probe", "SERVICE_NAME=pinger", "IMAGE=pinger:1.0"}
+			if tt.value != "" {
+				lines = append(lines, "DOCKER_SOCK="+tt.value)
+			}
+			// the process env is not where it comes from
+			defer setenv(t, "DOCKER_SOCK", "unix:///from/the/process.sock")()
+			inDir(t, lines, func() {
+				c, err := getConfig(getcontainerEnv(), false)
+				if tt.wantErr {
+					if err == nil || !strings.Contains(err.Error(), "DOCKER_SOCK") {
+						t.Fatalf("got error %v, want one about DOCKER_SOCK", err)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("getConfig: %v", err)
+				}
+				if c.DockerSock != tt.want {
+					t.Errorf("got %q, want %q", c.DockerSock, tt.want)
+				}
+			})
+		})
+	}
+}
+
+// attachedSpec is a service on networks, labelled as belonging to stack if that is set
+func attachedSpec(name, stack string, networks ...string) swarm.ServiceSpec {
+	spec := replicatedSpec(name, 1)
+	if stack != "" {
+		spec.Labels = map[string]string{stackLabel: stack}
+	}
+	for _, network := range networks {
+		spec.Networks = append(spec.Networks, swarm.NetworkAttachmentConfig{Target: network})
+	}
+	return spec
+}
+
+func TestServiceListFilter(t *testing.T) {
+	fake := newFakeDocker()
+	fake.addService(attachedSpec("probe_net1_pinger", "probe", "net1-id"))
+	fake.addService(attachedSpec("probe_net2_pinger", "probe", "net2-id"))
+	fake.addService(attachedSpec("other_net1_pinger", "other", "net1-id"))
+	fake.addService(attachedSpec("web", "", "net1-id"))
+	// the namespace label carries the network too, so it is no use for finding ours
+	namespaced := attachedSpec("probe_net3_pinger", "", "net3-id")
+	namespaced.Labels = map[string]string{"com.docker.stack.namespace": "probe"}
+	fake.addService(namespaced)
+
+	tests := []struct {
+		namespace string
+		want      []string
+	}{
+		{namespace: "probe", want: []string{"probe_net1_pinger", "probe_net2_pinger"}},
+		{namespace: "other", want: []string{"other_net1_pinger"}},
+		{namespace: "none", want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			services, err := ServiceListFilter(context.Background(), fake, tt.namespace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, service := range services {
+				got = append(got, service.Spec.Name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountNetworkServices(t *testing.T) {
+	fake := newFakeDocker()
+	fake.addService(attachedSpec("probe_net1_pinger", "probe", "net1-id"))
+	fake.addService(attachedSpec("probe_net2_pinger", "probe", "net2-id"))
+	fake.addService(attachedSpec("web", "", "net1-id", "net2-id"))
+	fake.addService(attachedSpec("other_net1_pinger", "other", "net1-id"))
+	twice := attachedSpec("db", "", "net1-id")
+	twice.TaskTemplate.Networks = twice.Networks
+	fake.addService(twice)
+
+	c := testConfig(t, baseEnv())
+	counts, err := countNetworkServices(testContext(c), fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// everything, ours included - a service on a network twice is counted once
+	want := map[string]int{"net1-id": 4, "net2-id": 2}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("all services: got %v, want %v", counts, want)
+	}
+
+	counts, err = countOtherServices(testContext(c), fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// our own stack is left out, another composer stack is not
+	want = map[string]int{"net1-id": 3, "net2-id": 1}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("other services: got %v, want %v", counts, want)
+	}
+
+	// without a stack name, nothing is ours - so nothing is left out
+	c.StackName = ""
+	counts, err = countOtherServices(testContext(c), fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]int{"net1-id": 4, "net2-id": 2}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("no stack name: got %v, want %v", counts, want)
+	}
+}
+
+func TestGetNetworkStatus(t *testing.T) {
+	fake := newFakeDocker()
+	fake.networks = []types.NetworkResource{
+		{
+			ID: "backend-id", Name: "backend", Driver: "overlay", Scope: "swarm", Attachable: true,
+			IPAM:  network.IPAM{Config: []network.IPAMConfig{{Subnet: "10.0.1.0/24"}, {Subnet: "fd00:1::/64"}}},
+			Peers: []network.PeerInfo{{Name: "node1", IP: "192.168.0.1"}, {Name: "node2", IP: "192.168.0.2"}},
+		},
+		{ID: "bare-id", Name: "bare", Driver: "overlay", Scope: "swarm"},
+	}
+	fake.addService(attachedSpec("probe_backend_pinger", "probe", "backend-id"))
+	fake.addService(attachedSpec("web", "", "backend-id"))
+	fake.addService(attachedSpec("db", "", "bare-id"))
+	ctx := testContext(testConfig(t, baseEnv()))
+
+	tests := []struct {
+		name string
+		want NetworkStatus
+	}{
+		{name: "backend", want: NetworkStatus{Name: "backend", Driver: "overlay", Subnet: "10.0.1.0/24", Peers: 2, ServiceCount: 2, Attachable: true}},
+		{name: "backend-id", want: NetworkStatus{Name: "backend", Driver: "overlay", Subnet: "10.0.1.0/24", Peers: 2, ServiceCount: 2, Attachable: true}},
+		// no ipam config or peers to report
+		{name: "bare", want: NetworkStatus{Name: "bare", Driver: "overlay", ServiceCount: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := GetNetworkStatus(ctx, fake, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	if _, err := GetNetworkStatus(ctx, fake, "gone"); err == nil || !strings.Contains(err.Error(), "No such network") {
+		t.Errorf("missing network: got %v", err)
+	}
+
+	var out bytes.Buffer
+	networks := []targetNetwork{{id: "backend-id", name: "backend"}, {id: "bare-id", name: "bare"}}
+	if err := printNetworkStatus(ctx, fake, &out, networks); err != nil {
+		t.Fatal(err)
+	}
+	want := "NAME     DRIVER   SUBNET       PEERS  SERVICES  ATTACHABLE\n" +
+		"backend  overlay  10.0.1.0/24  2      2         true\n" +
+		"bare     overlay               0      1         false\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+	// a network gone between listing and inspecting stops the table
+	networks = append(networks, targetNetwork{id: "gone-id", name: "gone"})
+	if err := printNetworkStatus(ctx, fake, ioutil.Discard, networks); err == nil {
+		t.Error("got no error for a missing network")
+	}
+}
+
+func TestNetworkStatusServiceCount(t *testing.T) {
+	fake := newFakeDocker()
+	fake.networks = []types.NetworkResource{
+		{ID: "net1-id", Name: "net1", Driver: "overlay", Scope: "swarm"},
+		{ID: "net2-id", Name: "net2", Driver: "overlay", Scope: "swarm"},
+		{ID: "net3-id", Name: "net3", Driver: "overlay", Scope: "swarm"},
+	}
+	fake.addService(attachedSpec("probe_net1_pinger", "probe", "net1-id"))
+	fake.addService(attachedSpec("web", "", "net1-id", "net2-id"))
+	c := testConfig(t, baseEnv())
+	ctx := testContext(c)
+	networks := getNetworkList(ctx, fake)
+
+	fake.serviceLists = 0
+	var out bytes.Buffer
+	if err := printNetworkStatus(ctx, fake, &out, networks); err != nil {
+		t.Fatal(err)
+	}
+	// one list for the whole table, not one per network
+	if fake.serviceLists != 1 {
+		t.Errorf("services listed %d times, want once", fake.serviceLists)
+	}
+	// our own service is shown - it is attached, after all
+	want := map[string]string{"net1": "2", "net2": "1", "net3": "0"}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n")[1:] {
+		// no subnets here, so that column is blank - count from the end
+		fields := strings.Fields(line)
+		if got := fields[len(fields)-2]; got != want[fields[0]] {
+			t.Errorf("%s: %s services, want %s", fields[0], got, want[fields[0]])
+		}
+	}
+}
+
+func TestNetworkMaxServicesOwnService(t *testing.T) {
+	fake := newFakeDocker()
+	fake.networks = []types.NetworkResource{
+		{ID: "net1-id", Name: "net1", Driver: "overlay", Scope: "swarm"},
+		{ID: "net2-id", Name: "net2", Driver: "overlay", Scope: "swarm"},
+	}
+	fake.addService(attachedSpec("probe_net1_pinger", "probe", "net1-id"))
+	fake.addService(attachedSpec("web", "", "net2-id"))
+
+	c := testConfig(t, baseEnv("NETWORK_MAX_SERVICES=1"))
+	networks, err := paginateNetworks(testContext(c), fake, networkPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// net1 only holds our own service, so is still ours - net2 is full
+	if len(networks) != 1 || networks[0].name != "net1" {
+		t.Errorf("got %+v, want net1 only", networks)
+	}
+}
+
+func TestBuiltinValidators(t *testing.T) {
+	tests := []struct {
+		name    string
+		pairs   []string
+		wantErr string
+	}{
+		{name: "defaults"},
+		{name: "port", pairs: []string{"PORT=8111"}},
+		{name: "port bounds", pairs: []string{"PORT=65535"}},
+		{name: "port zero", pairs: []string{"PORT=0"}, wantErr: "PORT"},
+		{name: "port too high", pairs: []string{"PORT=65536"}, wantErr: "PORT"},
+		{name: "port not a number", pairs: []string{"PORT=http"}, wantErr: "PORT"},
+		{name: "no cycle", pairs: []string{"CYCLE_TIME_SECONDS=0"}, wantErr: "CYCLE_TIME_SECONDS must be at least 5, got 0"},
+		{name: "short cycle", pairs: []string{"CYCLE_TIME_SECONDS=4"}, wantErr: "CYCLE_TIME_SECONDS must be at least 5, got 4"},
+		{name: "shortest cycle", pairs: []string{"CYCLE_TIME_SECONDS=5"}},
+		{name: "long cycle", pairs: []string{"CYCLE_TIME_SECONDS=100"}},
+		{name: "avoid masters off", pairs: []string{"AVOID_MASTERS=0"}},
+		{name: "avoid masters on", pairs: []string{"AVOID_MASTERS=1"}},
+		{name: "avoid masters typo", pairs: []string{"AVOID_MASTERS=11"}, wantErr: "AVOID_MASTERS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := getConfig(baseEnv(tt.pairs...), false)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("getConfig: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want one about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+type stackPrefixValidator string
+
+func (v stackPrefixValidator) Validate(c *config) error {
+	if !strings.HasPrefix(c.StackName, string(v)) {
+		return fmt.Errorf("STACK_NAME must start with %s", string(v))
+	}
+	return nil
+}
+
+func TestRegisterValidator(t *testing.T) {
+	saved := validators
+	defer func() { validators = saved }()
+	RegisterValidator(stackPrefixValidator("team-"))
+
+	if _, err := getConfig(baseEnv(), false); err == nil || !strings.Contains(err.Error(), "must start with team-") {
+		t.Errorf("got error %v, want the registered validator's", err)
+	}
+	if _, err := getConfig(baseEnv("STACK_NAME=team-probe"), false); err != nil {
+		t.Errorf("getConfig: %v", err)
+	}
+	// built-in checks still run first
+	if _, err := getConfig(baseEnv("STACK_NAME=team-probe", "PORT=70000"), false); err == nil || !strings.Contains(err.Error(), "PORT") {
+		t.Errorf("got error %v, want the PORT one", err)
+	}
+}
+
+func TestApplyServiceLogsRunID(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	log.SetPrefix("[run-1] ")
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetPrefix("")
+	}()
+
+	fake := newFakeDocker()
+	fake.addService(attachedSpec("updated", "probe"))
+	c := testConfig(t, baseEnv())
+	report := DeployReport{}
+	for _, spec := range []swarm.ServiceSpec{replicatedSpec("created", 1), attachedSpec("updated", "probe")} {
+		applyService(testContext(c), fake, spec, "net1", &report)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), out.String())
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "[run-1] ") {
+			t.Errorf("no run id on %q", line)
+		}
+	}
+}
+
+func TestDeployHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks run with /bin/sh")
+	}
+	dir, err := ioutil.TempDir("", "composer-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name        string
+		pre         string
+		post        string
+		wantCreated bool
+		wantCalls   string
+	}{
+		{name: "both succeed", wantCreated: true, wantCalls: "pre svc net1\npost svc net1\n"},
+		{name: "pre-deploy fails", pre: "exit 3", wantCalls: ""},
+		// exec, so that it is the sleep itself that gets killed
+		{name: "pre-deploy hangs", pre: "exec sleep 10", wantCalls: ""},
+		{name: "post-deploy fails", post: "exit 3", wantCreated: true, wantCalls: "pre svc net1\n"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := filepath.Join(dir, fmt.Sprintf("calls-%d", i))
+			record := func(hook, override string) string {
+				if override != "" {
+					return override
+				}
+				return "echo " + hook + " $SERVICE_NAME $NETWORK >> " + calls
+			}
+			c := testConfig(t, baseEnv("PRE_DEPLOY_HOOK="+record("pre", tt.pre), "POST_DEPLOY_HOOK="+record("post", tt.post)))
+			c.HookTimeout = 100 * time.Millisecond
+			fake := newFakeDocker()
+			report := DeployReport{}
+			start := time.Now()
+			applyService(testContext(c), fake, replicatedSpec("svc", 1), "net1", &report)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("took %s", elapsed)
+			}
+			if created := len(fake.created) == 1; created != tt.wantCreated {
+				t.Errorf("created: got %v, want %v (report %+v)", created, tt.wantCreated, report)
+			}
+			if failed := len(report.Failed) == 1; failed == tt.wantCreated {
+				t.Errorf("failed: got %v, want %v", report.Failed, !tt.wantCreated)
+			}
+			data, err := ioutil.ReadFile(calls)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantCalls {
+				t.Errorf("hooks ran as %q, want %q", data, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "default", want: 10 * time.Second},
+		{name: "set", value: "120", want: 2 * time.Minute},
+		{name: "zero", value: "0", wantErr: true},
+		{name: "not a number", value: "10s", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv()
+			if tt.value != "" {
+				e = baseEnv("HOOK_TIMEOUT_SECONDS=" + tt.value)
+			}
+			c, err := getConfig(e, false)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "HOOK_TIMEOUT_SECONDS") {
+					t.Fatalf("got error %v, want one about HOOK_TIMEOUT_SECONDS", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			if c.HookTimeout != tt.want {
+				t.Errorf("got %s, want %s", c.HookTimeout, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandEnvVars(t *testing.T) {
+	defer setenv(t, "VERSION", "1.2.3")()
+	defer setenv(t, "REGISTRY", "registry.example.com")()
+	os.Unsetenv("COMPOSER_UNDEFINED")
+	lines := []string{
+		"IMAGE=${REGISTRY}/pinger:$VERSION",
+		"BARE=$VERSION",
+		"BRACED=v${VERSION}-rc",
+		"ESCAPED=cost $$5",
+		"UNDEFINED=[$COMPOSER_UNDEFINED]",
+		"PLAIN=no references",
+	}
+	tests := []struct {
+		name   string
+		expand bool
+		want   map[string]string
+	}{
+		{
+			name:   "on",
+			expand: true,
+			want: map[string]string{
+				"IMAGE":     "registry.example.com/pinger:1.2.3",
+				"BARE":      "1.2.3",
+				"BRACED":    "v1.2.3-rc",
+				"ESCAPED":   "cost $5",
+				"UNDEFINED": "[]",
+				"PLAIN":     "no references",
+			},
+		},
+		{
+			// existing .env files keep their $ characters unless asked
+			name: "off",
+			want: map[string]string{
+				"IMAGE":   "${REGISTRY}/pinger:$VERSION",
+				"ESCAPED": "cost $$5",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := append([]string{}, lines...)
+			if tt.expand {
+				l = append(l, "EXPAND_ENV_VARS=1")
+			}
+			inDir(t, l, func() {
+				e := getcontainerEnv()
+				for k, want := range tt.want {
+					if got := e[k].value; got != want {
+						t.Errorf("%s: got %q, want %q", k, got, want)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestBackoffDialer(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets only")
+	}
+	dir, err := ioutil.TempDir("", "composer-sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		upAfter time.Duration
+		retries int
+		wantErr bool
+	}{
+		{name: "already up", retries: 0},
+		{name: "comes up while retrying", upAfter: 60 * time.Millisecond, retries: 6},
+		{name: "never up", retries: 2, wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("docker-%d.sock", i))
+			listen := func() {
+				l, err := net.Listen("unix", path)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				go func() {
+					conn, err := l.Accept()
+					if err == nil {
+						conn.Close()
+					}
+					l.Close()
+				}()
+			}
+			switch {
+			case tt.wantErr:
+				// nothing listening, ever
+			case tt.upAfter == 0:
+				listen()
+			default:
+				// the daemon is still starting - the socket isn't there yet
+				time.AfterFunc(tt.upAfter, listen)
+			}
+			dialer := backoffDialer{path: path, retries: tt.retries, delay: 10 * time.Millisecond, timeout: time.Second}
+			conn, err := dialer.DialContext(context.Background(), "unix", path)
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DialContext: %v", err)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestBackoffDialerCancelled(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets only")
+	}
+	dialer := backoffDialer{path: filepath.Join(os.TempDir(), "composer-missing.sock"), retries: 10, delay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := dialer.DialContext(ctx, "unix", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the context's error", err)
+	}
+}
+
+func TestDuplicateNetworkNames(t *testing.T) {
+	fake := newFakeDocker()
+	fake.networks = []types.NetworkResource{
+		{ID: "bbbbbbbbbbbb2222", Name: "shared", Driver: "overlay", Scope: "swarm"},
+		{ID: "aaaaaaaaaaaa1111", Name: "shared", Driver: "overlay", Scope: "swarm"},
+		{ID: "cccccccccccc3333", Name: "other", Driver: "overlay", Scope: "swarm"},
+	}
+	c := testConfig(t, baseEnv())
+	networks := getNetworkList(testContext(c), fake)
+	if len(networks) != 3 {
+		t.Fatalf("got %d networks, want 3", len(networks))
+	}
+
+	worklist, err := BuildWorklist(networks, []string{"node1"}, c, baseEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each of the two gets a service of its own, attached to it by id
+	want := map[string]string{
+		"probe_other_pinger":               "cccccccccccc3333",
+		"probe_shared_aaaaaaaaaaaa_pinger": "aaaaaaaaaaaa1111",
+		"probe_shared_bbbbbbbbbbbb_pinger": "bbbbbbbbbbbb2222",
+	}
+	got := make(map[string]string)
+	for _, spec := range worklist {
+		got[spec.Name] = getTargetNetwork(spec)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	e := baseEnv("PNPN=2", "REGISTRY_PASSWORD=hunter2", "client_secret=s3cr3t", "API_TOKEN=t0k3n")
+	c := testConfig(t, e)
+	var out bytes.Buffer
+	if err := dumpConfig(&out, *c, e); err != nil {
+		t.Fatal(err)
+	}
+	var dump struct {
+		Config map[string]interface{} `json:"config"`
+		Env    map[string]string      `json:"env"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &dump); err != nil {
+		t.Fatalf("not json: %v\n%s", err, out.String())
+	}
+	// what was set, and the defaults for what wasn't
+	wantConfig := map[string]interface{}{"PnPn": 2.0, "StackName": "probe", "AvoidMasters": 1.0, "CycleTime": 30.0, "AttachmentLevel": "service"}
+	for k, want := range wantConfig {
+		if got := dump.Config[k]; got != want {
+			t.Errorf("config %s: got %v, want %v", k, got, want)
+		}
+	}
+	wantEnv := map[string]string{
+		"IMAGE":             "pinger:1.0",
+		"REGISTRY_PASSWORD": "[REDACTED]",
+		"client_secret":     "[REDACTED]",
+		"API_TOKEN":         "[REDACTED]",
+	}
+	for k, want := range wantEnv {
+		if got := dump.Env[k]; got != want {
+			t.Errorf("env %s: got %q, want %q", k, got, want)
+		}
+	}
+	for _, secret := range []string{"hunter2", "s3cr3t", "t0k3n"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("%q in the dump", secret)
+		}
+	}
+}
+
+func TestAvoidNetworks(t *testing.T) {
+	const fullID = "4f1c2b3a5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f708"
+	network := types.NetworkResource{ID: fullID, Name: "backend", Driver: "overlay", Scope: "swarm"}
+	tests := []struct {
+		name  string
+		avoid string
+		want  string
+	}{
+		{name: "name", avoid: "backend", want: "avoid"},
+		{name: "full id", avoid: fullID, want: "avoid"},
+		{name: "short id", avoid: fullID[:12], want: "avoid"},
+		{name: "one of several", avoid: "frontend," + fullID[:12], want: "avoid"},
+		{name: "other network", avoid: "frontend", want: ""},
+		{name: "partial id", avoid: fullID[:6], want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, baseEnv("AVOID_NETWORKS="+tt.avoid))
+			if got := getSkipReason(network, c); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoDefaultAvoid(t *testing.T) {
+	tests := []struct {
+		name           string
+		avoid          string
+		noDefaultAvoid bool
+		want           map[string]string
+	}{
+		{name: "default", want: map[string]string{"ingress": "ingress"}},
+		{name: "explicit", avoid: "backend", want: map[string]string{"ingress": "ingress", "backend": "backend"}},
+		{name: "no default", noDefaultAvoid: true, want: map[string]string{}},
+		{name: "explicit, no default", avoid: "backend", noDefaultAvoid: true, want: map[string]string{"backend": "backend"}},
+		// listing it by hand still works, whatever the flag says
+		{name: "ingress listed, no default", avoid: "ingress,backend", noDefaultAvoid: true, want: map[string]string{"ingress": "ingress", "backend": "backend"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv()
+			if tt.avoid != "" {
+				e = baseEnv("AVOID_NETWORKS=" + tt.avoid)
+			}
+			c, err := getConfig(e, tt.noDefaultAvoid)
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			if !reflect.DeepEqual(c.AvoidNetworks, tt.want) {
+				t.Errorf("got %v, want %v", c.AvoidNetworks, tt.want)
+			}
+			ingress := types.NetworkResource{ID: "ingress-id", Name: "ingress", Driver: "overlay", Scope: "swarm"}
+			_, avoided := tt.want["ingress"]
+			if got := getSkipReason(ingress, &c) == "avoid"; got != avoided {
+				t.Errorf("ingress avoided: got %v, want %v", got, avoided)
+			}
+		})
+	}
+}
+
+func TestConfigContext(t *testing.T) {
+	c := testConfig(t, baseEnv())
+	ctx := WithConfig(context.Background(), c)
+
+	got, ok := ConfigFromContext(ctx)
+	if !ok || got != c {
+		t.Fatalf("got %p (%v), want %p", got, ok, c)
+	}
+	// survives being wrapped, as it is on the way down to the helpers
+	wrapped, cancel := context.WithTimeout(withRetryBudget(ctx, 3), time.Minute)
+	defer cancel()
+	if got, ok := ConfigFromContext(wrapped); !ok || got != c {
+		t.Errorf("lost through wrapping: got %p (%v)", got, ok)
+	}
+	if got := mustConfig(wrapped); got != c {
+		t.Errorf("mustConfig: got %p, want %p", got, c)
+	}
+
+	for name, ctx := range map[string]context.Context{
+		"none":      context.Background(),
+		"nil":       WithConfig(context.Background(), nil),
+		"plain key": context.WithValue(context.Background(), "composer.config", c),
+	} {
+		if _, ok := ConfigFromContext(ctx); ok {
+			t.Errorf("%s: found a config", name)
+		}
+	}
+}
+
+func TestMustConfigPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic without a config")
+		}
+	}()
+	mustConfig(context.Background())
+}
+
+func TestSecretsDir(t *testing.T) {
+	lines := []string{"API_TOKEN=from-dot-env", "IMAGE=pinger:1.0"}
+	t.Run("overrides .env", func(t *testing.T) {
+		inDir(t, lines, func() {
+			// inDir points ENV_SECRETS_DIR at ./secrets
+			if err := os.Mkdir("secrets", 0700); err != nil {
+				t.Fatal(err)
+			}
+			files := map[string]string{"API_TOKEN": "from-secret\n", "DB_PASSWORD": "pa=ss\r\n"}
+			for name, data := range files {
+				if err := ioutil.WriteFile(filepath.Join("secrets", name), []byte(data), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// directories in there are not secrets
+			if err := os.Mkdir(filepath.Join("secrets", "nested"), 0700); err != nil {
+				t.Fatal(err)
+			}
+			e := getcontainerEnv()
+			want := map[string]string{"API_TOKEN": "from-secret", "DB_PASSWORD": "pa=ss", "IMAGE": "pinger:1.0"}
+			for k, v := range want {
+				if got := e[k].value; got != v {
+					t.Errorf("%s: got %q, want %q", k, got, v)
+				}
+			}
+			if _, present := e["nested"]; present {
+				t.Error("directory read as a secret")
+			}
+		})
+	})
+	t.Run("no secrets dir", func(t *testing.T) {
+		inDir(t, lines, func() {
+			if got := getcontainerEnv()["API_TOKEN"].value; got != "from-dot-env" {
+				t.Errorf("got %q, want the .env value", got)
+			}
+		})
+	})
+}
+
+// webhookRecorder collects the events posted to it, answering with statuses in turn (then 200)
+type webhookRecorder struct {
+	statuses []int
+	events   []serviceEvent
+	calls    int
+}
+
+func (r *webhookRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.calls++
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var event serviceEvent
+	if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		if status >= 300 {
+			w.WriteHeader(status)
+			return
+		}
+	}
+	r.events = append(r.events, event)
+}
+
+func TestEventWebhook(t *testing.T) {
+	recorder := &webhookRecorder{}
+	hook := httptest.NewServer(recorder)
+	defer hook.Close()
+
+	fake := newFakeDocker()
+	fake.addService(attachedSpec("old", "probe"))
+	gone := attachedSpec("probe_gone_pinger", "probe")
+	fake.addService(gone)
+	c := testConfig(t, baseEnv("EVENT_WEBHOOK_URL="+hook.URL))
+	ctx := testContext(c)
+	report := DeployReport{}
+	applyService(ctx, fake, replicatedSpec("new", 1), "net1", &report)
+	applyService(ctx, fake, attachedSpec("old", "probe"), "net1", &report)
+	if err := purgeServices(ctx, fake, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []serviceEvent{
+		{Event: "service_created", Name: "new"},
+		{Event: "service_updated", Name: "old"},
+		{Event: "service_removed", Name: "old"},
+		{Event: "service_removed", Name: "probe_gone_pinger"},
+	}
+	if len(recorder.events) != len(want) {
+		t.Fatalf("got %+v, want %+v", recorder.events, want)
+	}
+	// purge removes in whatever order the daemon lists the services
+	removed := recorder.events[2:]
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Name < removed[j].Name })
+	for i, event := range recorder.events {
+		if event.Event != want[i].Event || event.Name != want[i].Name {
+			t.Errorf("event %d: got %+v, want %+v", i, event, want[i])
+		}
+		if _, err := time.Parse(time.RFC3339, event.Timestamp); err != nil {
+			t.Errorf("event %d: timestamp %q: %v", i, event.Timestamp, err)
+		}
+	}
+}
+
+func TestEventWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		wantCalls  int
+		wantEvents int
+	}{
+		{name: "first time", wantCalls: 1, wantEvents: 1},
+		{name: "retried once", statuses: []int{http.StatusBadGateway}, wantCalls: 2, wantEvents: 1},
+		{name: "given up on", statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, wantCalls: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := &webhookRecorder{statuses: tt.statuses}
+			hook := httptest.NewServer(recorder)
+			defer hook.Close()
+			notifyWebhook(hook.URL, "service_created", "new")
+			if recorder.calls != tt.wantCalls || len(recorder.events) != tt.wantEvents {
+				t.Errorf("got %d calls and %d events, want %d and %d", recorder.calls, len(recorder.events), tt.wantCalls, tt.wantEvents)
+			}
+		})
+	}
+	// nothing configured, nothing sent
+	notifyWebhook("", "service_created", "new")
+}
+
+func TestConfigDiff(t *testing.T) {
+	tests := []struct {
+		name  string
+		pairs []string
+		want  []string
+	}{
+		{name: "identical", want: []string{}},
+		{name: "one field", pairs: []string{"CYCLE_TIME_SECONDS=10"}, want: []string{"CycleTime: 30 -> 10"}},
+		{
+			name:  "several fields",
+			pairs: []string{"CYCLE_TIME_SECONDS=10", "AVOID_NETWORKS=backend", "COMMAND=ping -c 1"},
+			want: []string{
+				"AvoidNetworks: map[ingress:ingress] -> map[backend:backend ingress:ingress]",
+				"CycleTime: 30 -> 10",
+				"Command: [] -> [ping -c 1]",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testConfig(t, baseEnv())
+			b := testConfig(t, baseEnv(tt.pairs...))
+			got := ConfigDiff(a, b)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpecHash(t *testing.T) {
+	build := func(pairs ...string) swarm.ServiceSpec {
+		e := baseEnv(pairs...)
+		c := testConfig(t, e)
+		spec, err := getServiceDefinition(testContext(c), 2, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return spec
+	}
+	base := build("A=1", "B=2", "CONTAINER_LABELS=x=1,y=2").Labels[specHashLabel]
+	if base == "" {
+		t.Fatal("no spec hash label set")
+	}
+	tests := []struct {
+		name  string
+		pairs []string
+		same  bool
+	}{
+		{name: "same config", pairs: []string{"A=1", "B=2", "CONTAINER_LABELS=x=1,y=2"}, same: true},
+		{name: "same config, other order", pairs: []string{"B=2", "CONTAINER_LABELS=x=1,y=2", "A=1"}, same: true},
+		{name: "image changed", pairs: []string{"A=1", "B=2", "CONTAINER_LABELS=x=1,y=2", "IMAGE=pinger:2.0"}},
+		{name: "env changed", pairs: []string{"A=1", "B=3", "CONTAINER_LABELS=x=1,y=2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := build(tt.pairs...).Labels[specHashLabel]; (got == base) != tt.same {
+				t.Errorf("hash %s, first built with %s - want same: %v", got, base, tt.same)
+			}
+		})
+	}
+}
+
+func TestUpdateServiceSpecHash(t *testing.T) {
+	// a running service with our hash is left alone, whatever swarm filled in around it
+	desired := fingerprintSpec(t)
+	running := fingerprintSpec(t)
+	running.UpdateConfig = &swarm.UpdateConfig{Parallelism: 1}
+	running.TaskTemplate.RestartPolicy = &swarm.RestartPolicy{Condition: swarm.RestartPolicyConditionAny}
+	fake := newFakeDocker()
+	fake.addService(running)
+	c := testConfig(t, baseEnv())
+	if updated, err := updateService(testContext(c), fake, desired); err != nil || updated {
+		t.Fatalf("got %v, %v - want no update", updated, err)
+	}
+
+	// a new image is a new hash, so an update
+	desired.TaskTemplate.ContainerSpec.Image = "pinger:2.0"
+	desired.Labels[specHashLabel], _ = getSpecHash(desired)
+	if updated, err := updateService(testContext(c), fake, desired); err != nil || !updated {
+		t.Fatalf("got %v, %v - want an update", updated, err)
+	}
+	if got := fake.services[desired.Name].Spec.TaskTemplate.ContainerSpec.Image; got != "pinger:2.0" {
+		t.Errorf("running image %s, want pinger:2.0", got)
+	}
+}
+
+// testNode is a worker (or manager) node, available unless drained
+func testNode(hostname string, manager, drained bool) swarm.Node {
+	node := swarm.Node{ID: "id-" + hostname, Description: swarm.NodeDescription{Hostname: hostname}}
+	node.Spec.Role = swarm.NodeRoleWorker
+	if manager {
+		node.Spec.Role = swarm.NodeRoleManager
+	}
+	node.Spec.Availability = swarm.NodeAvailabilityActive
+	if drained {
+		node.Spec.Availability = swarm.NodeAvailabilityDrain
+	}
+	return node
+}
+
+func TestMaxDeployNodes(t *testing.T) {
+	fake := newFakeDocker()
+	for _, name := range []string{"node5", "node3", "node1", "node4", "node2"} {
+		fake.nodes = append(fake.nodes, testNode(name, false, false))
+	}
+	tests := []struct {
+		name         string
+		max          string
+		want         []string
+		wantExcluded []string
+	}{
+		{name: "canary", max: "2", want: []string{"node1", "node2"}, wantExcluded: []string{"id-node5", "id-node3", "id-node4"}},
+		{name: "more than there are", max: "9", want: []string{"node5", "node3", "node1", "node4", "node2"}},
+		{name: "no limit", want: []string{"node5", "node3", "node1", "node4", "node2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv()
+			if tt.max != "" {
+				e = baseEnv("MAX_DEPLOY_NODES=" + tt.max)
+			}
+			c := testConfig(t, e)
+			nodes, breakdown := getNodeList(testContext(c), fake)
+			if !reflect.DeepEqual(nodes, tt.want) {
+				t.Errorf("got %v, want %v", nodes, tt.want)
+			}
+			if !reflect.DeepEqual(breakdown.excluded, tt.wantExcluded) {
+				t.Errorf("excluded: got %v, want %v", breakdown.excluded, tt.wantExcluded)
+			}
+		})
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "composer-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	noImage := errors.New("Error response from daemon: no such image")
+	tests := []struct {
+		name        string
+		createErrs  []error
+		wantCreated []string
+		wantFailed  []string
+	}{
+		{name: "successful", wantCreated: []string{"svc1", "svc2"}, wantFailed: []string{}},
+		{name: "partial", createErrs: []error{nil, noImage}, wantCreated: []string{"svc1"}, wantFailed: []string{"svc2"}},
+		{name: "failed", createErrs: []error{noImage, noImage}, wantCreated: []string{}, wantFailed: []string{"svc1", "svc2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDocker()
+			fake.createErrs = tt.createErrs
+			c := testConfig(t, baseEnv("STARTUP_RETRIES=0"))
+			started := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+			report := DeployReport{RunID: "run-1", StartedAt: started, Created: []string{}, Updated: []string{}, Failed: []string{}, Skipped: []string{}, Deferred: []string{}, FailedNetworks: []string{}}
+			executeWorklist(testContext(c), fake, []swarm.ServiceSpec{replicatedSpec("svc1", 1), replicatedSpec("svc2", 1)}, nil, &report)
+			report.EndedAt = started.Add(1500 * time.Millisecond)
+			report.DurationMs = report.EndedAt.Sub(report.StartedAt).Milliseconds()
+
+			path := filepath.Join(dir, tt.name+".json")
+			if err := WriteReport(path, report); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatalf("not json: %v\n%s", err, data)
+			}
+			if got["started_at"] != "2026-01-02T03:04:05Z" || got["ended_at"] != "2026-01-02T03:04:06.5Z" || got["duration_ms"] != 1500.0 {
+				t.Errorf("times: got %v, %v, %v", got["started_at"], got["ended_at"], got["duration_ms"])
+			}
+			for field, want := range map[string][]string{"created": tt.wantCreated, "failed": tt.wantFailed, "skipped": {}} {
+				list, ok := got[field].([]interface{})
+				if !ok {
+					t.Errorf("%s: got %v, want a list", field, got[field])
+					continue
+				}
+				names := []string{}
+				for _, name := range list {
+					names = append(names, name.(string))
+				}
+				if !reflect.DeepEqual(names, want) {
+					t.Errorf("%s: got %v, want %v", field, names, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateConflictFallsBackToUpdate(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    bool
+		owner       string
+		createErrs  []error
+		wantUpdated []string
+		wantFailed  []string
+	}{
+		{name: "left over service", existing: true, owner: "probe", wantUpdated: []string{"svc"}},
+		{
+			name:        "another composer got there first",
+			existing:    true,
+			owner:       "probe",
+			createErrs:  []error{errors.New("Error response from daemon: service svc already exists")},
+			wantUpdated: []string{"svc"},
+		},
+		{
+			// the conflict came from a service that has since gone - nothing to update
+			name:       "gone again",
+			createErrs: []error{errors.New("Error response from daemon: rpc error: code = 2 desc = name conflicts with an existing object")},
+			wantFailed: []string{"svc"},
+		},
+		// not ours to take over
+		{name: "another stack's service", existing: true, owner: "other", wantFailed: []string{"svc"}},
+		{name: "made by hand", existing: true, wantFailed: []string{"svc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDocker()
+			if tt.existing {
+				fake.addService(attachedSpec("svc", tt.owner))
+			}
+			fake.createErrs = tt.createErrs
+			c := testConfig(t, baseEnv())
+			report := DeployReport{}
+			desired := attachedSpec("svc", "probe")
+			replicas := uint64(3)
+			desired.Mode.Replicated.Replicas = &replicas
+			applyService(testContext(c), fake, desired, "net1", &report)
+			if !reflect.DeepEqual(report.Updated, tt.wantUpdated) || !reflect.DeepEqual(report.Failed, tt.wantFailed) || len(report.Created) != 0 {
+				t.Errorf("got %+v, want updated %v, failed %v", report, tt.wantUpdated, tt.wantFailed)
+			}
+			if !tt.existing {
+				return
+			}
+			want := uint64(3)
+			if tt.wantUpdated == nil {
+				// left just as it was
+				want = 1
+			}
+			if got := replicasOf(fake.services["svc"].Spec); got != want {
+				t.Errorf("existing service has %d replicas, want %d", got, want)
+			}
+			if owner := fake.services["svc"].Spec.Labels[stackLabel]; owner != tt.owner && tt.wantUpdated == nil {
+				t.Errorf("existing service now belongs to %q", owner)
+			}
+		})
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want []string
+	}{
+		{name: "plain", list: "a,b,c", want: []string{"a", "b", "c"}},
+		{name: "escaped comma", list: `a\,b,c`, want: []string{"a,b", "c"}},
+		{name: "escaped at the end", list: `a,b\,`, want: []string{"a", "b,"}},
+		{name: "other backslashes kept", list: `a\b,c\`, want: []string{`a\b`, `c\`}},
+		{name: "single", list: "a", want: []string{"a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitList(tt.list); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscapedCommas(t *testing.T) {
+	e := baseEnv(
+		`AVOID_NETWORKS=odd\,name,backend`,
+		`CONTAINER_LABELS=com.example.owners=ops\,dev,tier=probe`,
+	)
+	c := testConfig(t, e)
+	for _, name := range []string{"odd,name", "backend"} {
+		if _, present := c.AvoidNetworks[name]; !present {
+			t.Errorf("AVOID_NETWORKS: %q missing from %v", name, c.AvoidNetworks)
+		}
+	}
+	if _, present := c.AvoidNetworks["odd"]; present {
+		t.Errorf("AVOID_NETWORKS split on an escaped comma: %v", c.AvoidNetworks)
+	}
+	wantLabels := map[string]string{"com.example.owners": "ops,dev", "tier": "probe"}
+	if !reflect.DeepEqual(c.ContainerLabels, wantLabels) {
+		t.Errorf("CONTAINER_LABELS: got %v, want %v", c.ContainerLabels, wantLabels)
+	}
+	network := types.NetworkResource{ID: "net-id", Name: "odd,name", Driver: "overlay"}
+	if got := getSkipReason(network, c); got != "avoid" {
+		t.Errorf("network odd,name: got %q, want avoid", got)
+	}
+}
+
+func TestNodeFilter(t *testing.T) {
+	fake := newFakeDocker()
+	fake.nodes = []swarm.Node{
+		testNode("mgr1", true, false),
+		testNode("node1", false, false),
+		testNode("node2", false, false),
+		testNode("node3", false, false),
+		testNode("node4", false, true),
+	}
+	tests := []struct {
+		name         string
+		pairs        []string
+		filter       string
+		want         []string
+		wantFiltered int
+		wantExcluded []string
+	}{
+		{name: "partial overlap", filter: "node3,node1,ghost", want: []string{"node1", "node3"}, wantFiltered: 1, wantExcluded: []string{"id-mgr1", "id-node2", "id-node4"}},
+		{name: "manager still avoided", pairs: []string{"AVOID_MASTERS=1"}, filter: "mgr1,node2", want: []string{"node2"}, wantFiltered: 2, wantExcluded: []string{"id-mgr1", "id-node1", "id-node3", "id-node4"}},
+		{name: "manager allowed", pairs: []string{"AVOID_MASTERS=0"}, filter: "mgr1,node2", want: []string{"mgr1", "node2"}, wantFiltered: 2, wantExcluded: []string{"id-node1", "id-node3", "id-node4"}},
+		{name: "drained never used", filter: "node4,node2", want: []string{"node2"}, wantFiltered: 2, wantExcluded: []string{"id-mgr1", "id-node1", "id-node3", "id-node4"}},
+		{name: "case folded", pairs: []string{"CASE_INSENSITIVE_NAMES=1"}, filter: "NODE2", want: []string{"node2"}, wantFiltered: 2, wantExcluded: []string{"id-mgr1", "id-node1", "id-node3", "id-node4"}},
+		{name: "nothing matches", filter: "ghost", want: []string{}, wantFiltered: 3, wantExcluded: []string{"id-mgr1", "id-node1", "id-node2", "id-node3", "id-node4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, baseEnv(tt.pairs...))
+			c.NodeFilter = getSubStringsMap(tt.filter)
+			nodes, breakdown := getNodeList(testContext(c), fake)
+			if !reflect.DeepEqual(nodes, tt.want) {
+				t.Errorf("got %v, want %v", nodes, tt.want)
+			}
+			if breakdown.filtered != tt.wantFiltered {
+				t.Errorf("filtered: got %d, want %d", breakdown.filtered, tt.wantFiltered)
+			}
+			if !reflect.DeepEqual(breakdown.excluded, tt.wantExcluded) {
+				t.Errorf("excluded: got %v, want %v", breakdown.excluded, tt.wantExcluded)
+			}
+		})
+	}
+	// without a filter, nothing is kept off any node
+	c := testConfig(t, baseEnv("AVOID_MASTERS=0"))
+	if _, breakdown := getNodeList(testContext(c), fake); breakdown.excluded != nil {
+		t.Errorf("no filter: got excluded %v, want none", breakdown.excluded)
+	}
+}
+
+func TestExcludedNodeConstraints(t *testing.T) {
+	e := baseEnv("ENGINE_LABELS=zone=a")
+	c := testConfig(t, e)
+	c.ExcludedNodes = []string{"id-node2", "id-mgr1"}
+	spec, err := getServiceDefinition(testContext(c), 1, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"engine.labels.zone==a", "node.id != id-node2", "node.id != id-mgr1"}
+	if spec.TaskTemplate.Placement == nil || !reflect.DeepEqual(spec.TaskTemplate.Placement.Constraints, want) {
+		t.Errorf("placement: got %+v, want %v", spec.TaskTemplate.Placement, want)
+	}
+	if want := []string{"engine.labels.zone==a"}; !reflect.DeepEqual(c.PlacementConstraints, want) {
+		t.Errorf("config constraints changed to %v", c.PlacementConstraints)
+	}
+}
+
+func TestApplyTimeout(t *testing.T) {
+	fake := newFakeDocker()
+	fake.createDelay = map[string]time.Duration{"slow1": time.Minute, "slow2": time.Minute, "fast2": 10 * time.Millisecond}
+	c := testConfig(t, baseEnv("STARTUP_RETRIES=0"))
+	c.ApplyTimeout = 100 * time.Millisecond
+	worklist := []swarm.ServiceSpec{replicatedSpec("slow1", 1), replicatedSpec("fast1", 1), replicatedSpec("slow2", 1), replicatedSpec("fast2", 1)}
+
+	report := DeployReport{}
+	start := time.Now()
+	executeWorklist(testContext(c), fake, worklist, nil, &report)
+	// each slow service used up only its own time, and the ones after it still got theirs
+	if !reflect.DeepEqual(report.Failed, []string{"slow1", "slow2"}) || !reflect.DeepEqual(report.Created, []string{"fast1", "fast2"}) {
+		t.Errorf("got failed %v, created %v", report.Failed, report.Created)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s", elapsed)
+	}
+}
+
+func TestCreateStagger(t *testing.T) {
+	const stagger = 200 * time.Millisecond
+	tests := []struct {
+		name     string
+		stagger  string
+		existing bool
+		// the least and most the run may take
+		min, max time.Duration
+	}{
+		// two pauses, between three creates - none after the last
+		{name: "creates", stagger: "200", min: 2 * stagger, max: 3*stagger + time.Second},
+		{name: "disabled", stagger: "0", max: stagger},
+		// only creates are followed by a pause
+		{name: "updates", stagger: "200", existing: true, max: stagger},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDocker()
+			worklist := []swarm.ServiceSpec{}
+			for _, name := range []string{"svc1", "svc2", "svc3"} {
+				if tt.existing {
+					fake.addService(attachedSpec(name, "probe"))
+				}
+				worklist = append(worklist, attachedSpec(name, "probe"))
+			}
+			c := testConfig(t, baseEnv("CREATE_STAGGER_MS="+tt.stagger))
+			report := DeployReport{}
+			start := time.Now()
+			executeWorklist(testContext(c), fake, worklist, nil, &report)
+			elapsed := time.Since(start)
+			if len(report.Created)+len(report.Updated) != 3 || len(report.Failed) != 0 {
+				t.Errorf("got %+v", report)
+			}
+			if elapsed < tt.min || elapsed > tt.max {
+				t.Errorf("took %s, want between %s and %s", elapsed, tt.min, tt.max)
+			}
+		})
+	}
+
+	// a run that is called off doesn't sit out the pause
+	fake := newFakeDocker()
+	c := testConfig(t, baseEnv("CREATE_STAGGER_MS=60000"))
+	ctx, cancel := context.WithTimeout(testContext(c), stagger)
+	defer cancel()
+	report := DeployReport{}
+	start := time.Now()
+	executeWorklist(ctx, fake, []swarm.ServiceSpec{replicatedSpec("svc1", 1), replicatedSpec("svc2", 1)}, nil, &report)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s", elapsed)
+	}
+	if !reflect.DeepEqual(report.Created, []string{"svc1"}) {
+		t.Errorf("got created %v, want svc1 only", report.Created)
+	}
+}
+
+func TestServiceNodeID(t *testing.T) {
+	const id = "x7k2m9q4w1e8r5t3y6u0i2o4p"
+	tests := []struct {
+		name    string
+		value   string
+		wantErr bool
+	}{
+		{name: "node id", value: id},
+		{name: "too short", value: id[:12], wantErr: true},
+		{name: "upper case", value: strings.ToUpper(id), wantErr: true},
+		{name: "hostname", value: "worker-01.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := baseEnv("SERVICE_NODE_ID=" + tt.value)
+			c, err := getConfig(e, false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("getConfig: %v", err)
+			}
+			spec, err := getServiceDefinition(testContext(&c), 1, targetNetwork{id: "id1", name: "net1", key: "net1"}, envs{"id1": e})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"node.id == " + id}
+			if spec.TaskTemplate.Placement == nil || !reflect.DeepEqual(spec.TaskTemplate.Placement.Constraints, want) {
+				t.Errorf("placement: got %+v, want %v", spec.TaskTemplate.Placement, want)
+			}
+		})
+	}
+}
+
+func TestVerifyNode(t *testing.T) {
+	node := func(id string, state swarm.NodeState, availability swarm.NodeAvailability) swarm.Node {
+		n := swarm.Node{ID: id}
+		n.Status.State = state
+		n.Spec.Availability = availability
+		return n
+	}
+	fake := newFakeDocker()
+	fake.nodes = []swarm.Node{
+		node("ready", swarm.NodeStateReady, swarm.NodeAvailabilityActive),
+		node("drained", swarm.NodeStateReady, swarm.NodeAvailabilityDrain),
+		node("down", swarm.NodeStateDown, swarm.NodeAvailabilityActive),
+	}
+	tests := []struct {
+		id      string
+		wantErr string
+	}{
+		{id: "ready"},
+		{id: "drained", wantErr: "not available"},
+		{id: "down", wantErr: "not available"},
+		{id: "missing", wantErr: "does not exist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			err := verifyNode(context.Background(), fake, tt.id)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyNode: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaxChangesConverges(t *testing.T) {
+	c := testConfig(t, baseEnv("MAX_CHANGES_PER_CYCLE=2"))
+	worklist, err := BuildWorklist(testNetworks("net1", "net2", "net3", "net4", "net5"), []string{"node1"}, c, baseEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeDocker()
+	// 5 services to create, 2 at a time - the rest are picked up by the following cycles
+	wantCreated := []int{2, 2, 1, 0}
+	for cycle, want := range wantCreated {
+		report := DeployReport{}
+		executeWorklist(testContext(c), fake, worklist, nil, &report)
+		if len(report.Created) != want || len(report.Failed) != 0 || len(report.Updated) != 0 {
+			t.Fatalf("cycle %d: got %+v, want %d created", cycle+1, report, want)
+		}
+		if deferred := len(worklist) - len(fake.created); len(report.Deferred) != deferred {
+			t.Errorf("cycle %d: %d deferred, want %d", cycle+1, len(report.Deferred), deferred)
+		}
+	}
+	if len(fake.services) != len(worklist) || len(fake.updated) != 0 {
+		t.Errorf("got %d services and %d updates, want %d and none", len(fake.services), len(fake.updated), len(worklist))
+	}
+}
+
+func TestCycleRetryBudget(t *testing.T) {
+	busy := retryableError{status: http.StatusServiceUnavailable, err: errors.New("Error response from daemon: swarm is busy")}
+	tests := []struct {
+		name      string
+		budget    string
+		wantCalls int
+	}{
+		// svc1 retries twice, svc2 once more and then finds the budget gone - svc3 and svc4 are never tried
+		{name: "budget", budget: "3", wantCalls: 5},
+		// per-call retries only: each service tries 1+STARTUP_RETRIES times
+		{name: "no budget", budget: "0", wantCalls: 4 * 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDocker()
+			for i := 0; i < 100; i++ {
+				fake.createErrs = append(fake.createErrs, busy)
+			}
+			c := testConfig(t, baseEnv("STARTUP_RETRIES=2", "STARTUP_RETRIES_DELAY_SECONDS=0", "MAX_CYCLE_RETRIES="+tt.budget))
+			ctx := withRetryBudget(testContext(c), c.MaxCycleRetries)
+			worklist := []swarm.ServiceSpec{replicatedSpec("svc1", 1), replicatedSpec("svc2", 1), replicatedSpec("svc3", 1), replicatedSpec("svc4", 1)}
+			report := DeployReport{}
+			executeWorklist(ctx, fake, worklist, nil, &report)
+			if calls := 100 - len(fake.createErrs); calls != tt.wantCalls {
+				t.Errorf("got %d create calls, want %d", calls, tt.wantCalls)
+			}
+			if len(report.Failed) != len(worklist) {
+				t.Errorf("failed: got %v, want all of them", report.Failed)
+			}
+		})
+	}
+}
+
+func TestPurgeConfirmed(t *testing.T) {
+	tests := []struct {
+		name  string
+		yes   bool
+		pairs []string
+		want  bool
+	}{
+		{name: "nothing", want: false},
+		{name: "--yes", yes: true, want: true},
+		{name: "CONFIRM_PURGE=1", pairs: []string{"CONFIRM_PURGE=1"}, want: true},
+		{name: "CONFIRM_PURGE=yes", pairs: []string{"CONFIRM_PURGE=yes"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := purgeConfirmed(tt.yes, baseEnv(tt.pairs...)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurgeServices(t *testing.T) {
+	fake := newFakeDocker()
+	fake.addService(attachedSpec("probe_net1_pinger", "probe", "net1-id"))
+	fake.addService(attachedSpec("probe_net2_pinger", "probe", "net2-id"))
+	fake.addService(attachedSpec("other_net1_pinger", "other", "net1-id"))
+	fake.addService(attachedSpec("web", "", "net1-id"))
+
+	c := testConfig(t, baseEnv())
+	var out bytes.Buffer
+	if err := purgeServices(testContext(c), fake, &out); err != nil {
+		t.Fatal(err)
+	}
+	removed := append([]string{}, fake.removed...)
+	sort.Strings(removed)
+	if want := []string{"probe_net1_pinger", "probe_net2_pinger"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+	for _, name := range []string{"other_net1_pinger", "web"} {
+		if _, present := fake.services[name]; !present {
+			t.Errorf("%s removed", name)
+		}
+	}
+	if got := strings.Count(out.String(), "removed "); got != 2 {
+		t.Errorf("printed %d removals:\n%s", got, out.String())
+	}
+
+	// without a stack name there is no telling what is ours
+	c.StackName = ""
+	if err := purgeServices(testContext(c), fake, ioutil.Discard); err == nil {
+		t.Error("purged without a STACK_NAME")
+	}
+}
+
+func TestGetPeerNodeCount(t *testing.T) {
+	peers := func(n int) []network.PeerInfo {
+		list := []network.PeerInfo{}
+		for i := 0; i < n; i++ {
+			list = append(list, network.PeerInfo{Name: fmt.Sprintf("node%d", i), IP: fmt.Sprintf("10.0.0.%d", i+1)})
+		}
+		return list
+	}
+	fake := newFakeDocker()
+	fake.networks = []types.NetworkResource{
+		{ID: "none-id", Name: "none"},
+		{ID: "one-id", Name: "one", Peers: peers(1)},
+		{ID: "many-id", Name: "many", Peers: peers(7)},
+	}
+	tests := []struct {
+		network string
+		want    int
+		wantErr bool
+	}{
+		{network: "none-id", want: 0},
+		{network: "one-id", want: 1},
+		{network: "many-id", want: 7},
+		{network: "missing-id", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			got, err := getPeerNodeCount(context.Background(), fake, tt.network)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %d peers, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCaseInsensitiveNames(t *testing.T) {
+	network := types.NetworkResource{ID: "net-id", Name: "BackEnd", Driver: "overlay", Labels: map[string]string{"com.docker.stack.namespace": "Shop"}}
+	tests := []struct {
+		name  string
+		pairs []string
+		want  string
+	}{
+		{name: "avoid, exact", pairs: []string{"AVOID_NETWORKS=BackEnd"}, want: "avoid"},
+		{name: "avoid, case differs", pairs: []string{"AVOID_NETWORKS=backend"}, want: ""},
+		{name: "avoid, case differs, folded", pairs: []string{"AVOID_NETWORKS=backend", "CASE_INSENSITIVE_NAMES=1"}, want: "avoid"},
+		{name: "target stack, case differs", pairs: []string{"TARGET_STACK=shop"}, want: "not-included"},
+		{name: "target stack, case differs, folded", pairs: []string{"TARGET_STACK=shop", "CASE_INSENSITIVE_NAMES=1"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, baseEnv(tt.pairs...))
+			if got := getSkipReason(network, c); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// and for REPLICA_OVERRIDES
+	overrideTests := []struct {
+		name      string
+		pairs     []string
+		network   string
+		want      uint64
+		wantFound bool
+	}{
+		{name: "override, exact", pairs: []string{"REPLICA_OVERRIDES=BackEnd=3"}, network: "BackEnd", want: 3, wantFound: true},
+		{name: "override, case differs", pairs: []string{"REPLICA_OVERRIDES=backend=3"}, network: "BackEnd"},
+		{name: "override, case differs, folded", pairs: []string{"REPLICA_OVERRIDES=backend=3", "CASE_INSENSITIVE_NAMES=1"}, network: "BackEnd", want: 3, wantFound: true},
+		{name: "override, exact beats folded", pairs: []string{"REPLICA_OVERRIDES=backend=3,BackEnd=5", "CASE_INSENSITIVE_NAMES=1"}, network: "BackEnd", want: 5, wantFound: true},
+	}
+	for _, tt := range overrideTests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, baseEnv(tt.pairs...))
+			if got, found := getReplicaOverride(c, tt.network); got != tt.want || found != tt.wantFound {
+				t.Errorf("got %d (%v), want %d (%v)", got, found, tt.want, tt.wantFound)
+			}
+			// and the worklist follows
+			worklist, err := BuildWorklist([]targetNetwork{{id: "net-id", name: tt.network, key: tt.network}}, []string{"node1", "node2"}, c, baseEnv(tt.pairs...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := uint64(2)
+			if tt.wantFound {
+				want = tt.want
+			}
+			if got := replicasOf(worklist[0]); got != want {
+				t.Errorf("replicas: got %d, want %d", got, want)
+			}
+		})
+	}
+
+	// and the same for node names
+	fake := newFakeDocker()
+	fake.nodes = []swarm.Node{testNode("Worker1", false, false), testNode("worker2", false, false)}
+	for _, fold := range []bool{false, true} {
+		e := baseEnv()
+		want := []string{}
+		if fold {
+			e = baseEnv("CASE_INSENSITIVE_NAMES=1")
+			want = []string{"Worker1"}
+		}
+		c := testConfig(t, e)
+		c.NodeFilter = getSubStringsMap("worker1")
+		if nodes, _ := getNodeList(testContext(c), fake); !reflect.DeepEqual(nodes, want) {
+			t.Errorf("node filter, folded %v: got %v, want %v", fold, nodes, want)
+		}
+	}
+}
+
+func TestNodeBreakdown(t *testing.T) {
+	tests := []struct {
+		name   string
+		nodes  []swarm.Node
+		filter string
+		want   nodeBreakdown
+	}{
+		{name: "no nodes", want: nodeBreakdown{}},
+		{
+			name:  "managers only",
+			nodes: []swarm.Node{testNode("mgr1", true, false), testNode("mgr2", true, false)},
+			want:  nodeBreakdown{total: 2, excludedManagers: 2},
+		},
+		{
+			name:  "all drained",
+			nodes: []swarm.Node{testNode("node1", false, true), testNode("node2", false, true), testNode("mgr1", true, false)},
+			want:  nodeBreakdown{total: 3, excludedManagers: 1, drained: 2},
+		},
+		{
+			name:   "filtered out",
+			nodes:  []swarm.Node{testNode("node1", false, false), testNode("node2", false, false)},
+			filter: "node9",
+			want:   nodeBreakdown{total: 2, filtered: 2, excluded: []string{"id-node1", "id-node2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDocker()
+			fake.nodes = tt.nodes
+			c := testConfig(t, baseEnv())
+			if tt.filter != "" {
+				c.NodeFilter = getSubStringsMap(tt.filter)
+			}
+			nodes, got := getNodeList(testContext(c), fake)
+			if len(nodes) != 0 {
+				t.Errorf("got nodes %v, want none", nodes)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	want := "3 nodes: 1 managers excluded by AVOID_MASTERS, 2 drained, 0 not in the node filter"
+	if got := (nodeBreakdown{total: 3, excludedManagers: 1, drained: 2}).String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestPruneServices(t *testing.T) {
+	setup := func() (*fakeDocker, []swarm.ServiceSpec) {
+		fake := newFakeDocker()
+		fake.addService(attachedSpec("probe_net1_pinger", "probe", "net1-id"))
+		// net2 has gone, and the stack was once called something else
+		fake.addService(attachedSpec("probe_net2_pinger", "probe", "net2-id"))
+		fake.addService(attachedSpec("old_net1_pinger", "probe", "net1-id"))
+		// not ours
+		fake.addService(attachedSpec("other_net2_pinger", "other", "net2-id"))
+		fake.addService(attachedSpec("web", "", "net2-id"))
+		return fake, []swarm.ServiceSpec{attachedSpec("probe_net1_pinger", "probe", "net1-id")}
+	}
+	c := testConfig(t, baseEnv())
+	stale := []string{"old_net1_pinger", "probe_net2_pinger"}
+
+	t.Run("prune", func(t *testing.T) {
+		fake, worklist := setup()
+		var out bytes.Buffer
+		if err := pruneServices(testContext(c), fake, &out, worklist, false); err != nil {
+			t.Fatal(err)
+		}
+		removed := append([]string{}, fake.removed...)
+		sort.Strings(removed)
+		if !reflect.DeepEqual(removed, stale) {
+			t.Errorf("removed %v, want %v", removed, stale)
+		}
+		for _, name := range stale {
+			if !strings.Contains(out.String(), "pruned "+name) {
+				t.Errorf("%s not printed:\n%s", name, out.String())
+			}
+		}
+	})
+	t.Run("dry run", func(t *testing.T) {
+		fake, worklist := setup()
+		var out bytes.Buffer
+		if err := pruneServices(testContext(c), fake, &out, worklist, true); err != nil {
+			t.Fatal(err)
+		}
+		if len(fake.removed) != 0 || len(fake.services) != 5 {
+			t.Errorf("dry run removed %v", fake.removed)
+		}
+		for _, name := range stale {
+			if !strings.Contains(out.String(), "would prune "+name) {
+				t.Errorf("%s not printed:\n%s", name, out.String())
+			}
+		}
+	})
+}
+
+func TestPruneMaxChanges(t *testing.T) {
+	fake := newFakeDocker()
+	for _, name := range []string{"probe_net4_pinger", "probe_net2_pinger", "probe_net1_pinger", "probe_net3_pinger"} {
+		fake.addService(attachedSpec(name, "probe"))
+	}
+	c := testConfig(t, baseEnv("MAX_CHANGES_PER_CYCLE=2"))
+	// 4 stale services, 2 a run - in name order, so each run picks up where the last one stopped
+	wantRemoved := [][]string{
+		{"probe_net1_pinger", "probe_net2_pinger"},
+		{"probe_net1_pinger", "probe_net2_pinger", "probe_net3_pinger", "probe_net4_pinger"},
+		{"probe_net1_pinger", "probe_net2_pinger", "probe_net3_pinger", "probe_net4_pinger"},
+	}
+	for run, want := range wantRemoved {
+		if err := pruneServices(testContext(c), fake, ioutil.Discard, nil, false); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fake.removed, want) {
+			t.Errorf("run %d: removed %v, want %v", run+1, fake.removed, want)
+		}
+	}
+}
+
+func TestRunPruneWithoutNetworks(t *testing.T) {
+	// every network has gone, and with it any reason to deploy - but the services left behind still need pruning
+	fake := newFakeDocker()
+	fake.addService(attachedSpec("probe_net1_pinger", "probe", "net1-id"))
+	fake.addService(attachedSpec("probe_net2_pinger", "probe", "net2-id"))
+	fake.addService(attachedSpec("web", "", "net1-id"))
+	c := testConfig(t, baseEnv())
+	ctx := testContext(c)
+
+	networks := getNetworkList(ctx, fake)
+	if len(networks) != 0 {
+		t.Fatalf("got networks %+v, want none", networks)
+	}
+	var out bytes.Buffer
+	if err := runPrune(ctx, fake, &out, networks, baseEnv(), false); err != nil {
+		t.Fatal(err)
+	}
+	removed := append([]string{}, fake.removed...)
+	sort.Strings(removed)
+	if want := []string{"probe_net1_pinger", "probe_net2_pinger"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+	if _, present := fake.services["web"]; !present {
+		t.Error("web removed")
+	}
+
+	// a network whose service can't be built would have its service look stale, so nothing is touched
+	fake = newFakeDocker()
+	fake.addService(attachedSpec("probe_net1_pinger", "probe", "net1-id"))
+	e := testEnv("STACK_NAME=probe", "SERVICE_NAME=pinger")
+	if err := runPrune(ctx, fake, ioutil.Discard, testNetworks("net1"), e, false); err == nil || len(fake.removed) != 0 {
+		t.Errorf("got %v and removed %v, want a refusal", err, fake.removed)
+	}
+}
+
+func TestEnvDiff(t *testing.T) {
+	tests := []struct {
+		name        string
+		before      []string
+		after       []string
+		wantAdded   []string
+		wantRemoved []string
+		wantChanged []string
+	}{
+		{name: "same", before: []string{"A=1", "B=2"}, after: []string{"B=2", "A=1"}},
+		{name: "both empty"},
+		{name: "added", before: []string{"A=1"}, after: []string{"A=1", "C=3", "B=2"}, wantAdded: []string{"B", "C"}},
+		{name: "removed", before: []string{"A=1", "B=2", "C=3"}, after: []string{"B=2"}, wantRemoved: []string{"A", "C"}},
+		{name: "changed", before: []string{"A=1", "B=2"}, after: []string{"A=1", "B=3"}, wantChanged: []string{"B"}},
+		{name: "emptied", before: []string{"A=1"}, after: []string{"A="}, wantChanged: []string{"A"}},
+		{
+			name:        "all at once",
+			before:      []string{"IMAGE=pinger:1.0", "DEBUG=1", "PNPN=1"},
+			after:       []string{"IMAGE=pinger:2.0", "PNPN=1", "MIN_NODES=3"},
+			wantAdded:   []string{"MIN_NODES"},
+			wantRemoved: []string{"DEBUG"},
+			wantChanged: []string{"IMAGE"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed, changed := testEnv(tt.before...).Diff(testEnv(tt.after...))
+			if !reflect.DeepEqual(added, tt.wantAdded) || !reflect.DeepEqual(removed, tt.wantRemoved) || !reflect.DeepEqual(changed, tt.wantChanged) {
+				t.Errorf("got added %v, removed %v, changed %v - want %v, %v, %v", added, removed, changed, tt.wantAdded, tt.wantRemoved, tt.wantChanged)
+			}
+		})
+	}
+}
+
+func TestCheckSwarmHealth(t *testing.T) {
+	// managers builds n managers, the first reachable ones of them, the first of those the leader
+	managers := func(n, reachable int) []swarm.Node {
+		nodes := []swarm.Node{testNode("worker1", false, false)}
+		for i := 0; i < n; i++ {
+			node := testNode(fmt.Sprintf("mgr%d", i), true, false)
+			node.ManagerStatus = &swarm.ManagerStatus{Reachability: swarm.ReachabilityUnreachable}
+			if i < reachable {
+				node.ManagerStatus.Reachability = swarm.ReachabilityReachable
+				node.ManagerStatus.Leader = i == 0
+			}
+			nodes = append(nodes, node)
+		}
+		return nodes
+	}
+	tests := []struct {
+		name    string
+		swarmID string
+		nodes   []swarm.Node
+		wantErr string
+	}{
+		{name: "single manager", swarmID: "swarm1", nodes: managers(1, 1)},
+		{name: "3 of 3", swarmID: "swarm1", nodes: managers(3, 3)},
+		{name: "2 of 3", swarmID: "swarm1", nodes: managers(3, 2)},
+		{name: "1 of 3", swarmID: "swarm1", nodes: managers(3, 1), wantErr: "quorum lost: 1 of 3"},
+		{name: "3 of 5", swarmID: "swarm1", nodes: managers(5, 3)},
+		{name: "2 of 5", swarmID: "swarm1", nodes: managers(5, 2), wantErr: "quorum lost: 2 of 5"},
+		{name: "2 of 4", swarmID: "swarm1", nodes: managers(4, 2), wantErr: "quorum lost: 2 of 4"},
+		{name: "no leader", swarmID: "swarm1", nodes: managers(3, 0), wantErr: "leader"},
+		{name: "no swarm", nodes: managers(1, 1), wantErr: "no swarm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDocker()
+			fake.swarm.ID = tt.swarmID
+			fake.nodes = tt.nodes
+			err := checkSwarmHealth(context.Background(), fake)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkSwarmHealth: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	// manager builds a reachable manager (the leader, when lead is set), or an unreachable one
+	manager := func(hostname string, reachable, lead bool) swarm.Node {
+		node := testNode(hostname, true, false)
+		node.ManagerStatus = &swarm.ManagerStatus{Reachability: swarm.ReachabilityUnreachable}
+		if reachable {
+			node.ManagerStatus.Reachability = swarm.ReachabilityReachable
+			node.ManagerStatus.Leader = lead
+		}
+		return node
+	}
+	healthy := []swarm.Node{manager("mgr1", true, true), testNode("node1", false, false), testNode("node2", false, false)}
+	tests := []struct {
+		name    string
+		state   swarm.LocalNodeState
+		worker  bool
+		nodes   []swarm.Node
+		want    string
+		wantErr string
+	}{
+		{
+			name:  "healthy",
+			nodes: healthy,
+			want:  "docker 1.13.1, swarm active and healthy, manager\n1 networks and 2 nodes would be targeted\n",
+		},
+		{name: "swarm not active", state: swarm.LocalNodeStateInactive, nodes: healthy, wantErr: "swarm is not active on this node, state is: inactive"},
+		{name: "swarm still joining", state: swarm.LocalNodeStatePending, nodes: healthy, wantErr: "state is: pending"},
+		{name: "not a manager", worker: true, nodes: healthy, wantErr: "this node is not a swarm manager"},
+		{
+			name:    "quorum lost",
+			nodes:   []swarm.Node{manager("mgr1", true, true), manager("mgr2", false, false), manager("mgr3", false, false), testNode("node1", false, false)},
+			wantErr: "swarm is not healthy: manager quorum lost: 1 of 3",
+		},
+		{
+			name:    "no leader",
+			nodes:   []swarm.Node{manager("mgr1", true, false), testNode("node1", false, false)},
+			wantErr: "swarm is not healthy: no manager is currently the leader",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeDocker()
+			fake.info.ServerVersion = "1.13.1"
+			fake.info.Swarm.LocalNodeState = swarm.LocalNodeStateActive
+			if tt.state != "" {
+				fake.info.Swarm.LocalNodeState = tt.state
+			}
+			fake.info.Swarm.ControlAvailable = !tt.worker
+			fake.swarm.ID = "swarm1"
+			fake.networks = []types.NetworkResource{{ID: "net1-id", Name: "net1", Driver: "overlay", Scope: "swarm"}}
+			fake.nodes = tt.nodes
+			c := testConfig(t, baseEnv())
+			var out bytes.Buffer
+			err := runCheck(testContext(c), fake, &out)
+			if len(fake.created)+len(fake.updated)+len(fake.removed) != 0 {
+				t.Errorf("check changed services: %+v", fake)
+			}
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("runCheck: %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMinNodes(t *testing.T) {
+	fake := newFakeDocker()
+	fake.nodes = []swarm.Node{testNode("node1", false, false), testNode("node2", false, false), testNode("node3", false, true)}
+	tests := []struct {
+		name     string
+		minNodes string
+		want     string
+	}{
+		{name: "disabled", minNodes: "0"},
+		{name: "enough", minNodes: "2"},
+		{name: "one drained too many", minNodes: "3", want: "only 2 eligible nodes, MIN_NODES is 3 (3 nodes: 0 managers excluded by AVOID_MASTERS, 1 drained, 0 not in the node filter)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig(t, baseEnv("MIN_NODES="+tt.minNodes))
+			nodes, breakdown := getNodeList(testContext(c), fake)
+			if got := tooFewNodes(c, nodes, breakdown); got != tt.want {
+				t.Errorf("skip reason: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkippedRunReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "composer-report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "report.json")
+
+	started := time.Now().UTC().Add(-time.Second)
+	report := DeployReport{RunID: "run-1", StartedAt: started, Created: []string{}}
+	report.SkipReason = "only 2 eligible nodes, MIN_NODES is 3"
+	report.finish(path)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("report not written: %v", err)
+	}
+	var got DeployReport
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.RunID != "run-1" || got.SkipReason != report.SkipReason {
+		t.Errorf("got run id %q, skip reason %q", got.RunID, got.SkipReason)
+	}
+	if got.EndedAt.Before(started) || got.DurationMs < 1000 {
+		t.Errorf("end not stamped: ended %v, took %dms", got.EndedAt, got.DurationMs)
+	}
+
+	// a run that went ahead has no skip_reason at all
+	report = DeployReport{RunID: "run-2"}
+	report.finish(path)
+	if b, err = ioutil.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "skip_reason") {
+		t.Errorf("got skip_reason in %s", b)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// R_OK | W_OK - a socket has to be both readable and writable to talk to the daemon
+const socketAccessMode = 0x4 | 0x2
+
+func checkSocketAccess(path string) error {
+	return socketAccessError(path, syscall.Access(path, socketAccessMode))
+}
+
+func socketAccessError(path string, err error) error {
+	// turns what access(2) said into something actionable. a missing socket is left to the dialer, which waits for the daemon to come up
+	if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("permission denied on docker socket %s - run as root, or as a member of the group that owns it (usually docker)", path)
+	}
+	return nil
+}
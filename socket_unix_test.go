@@ -0,0 +1,87 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestCheckSocketAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "composer-sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := filepath.Join(dir, "open.sock")
+	locked := filepath.Join(dir, "locked.sock")
+	// a plain file does as well as a socket - only the permissions are looked at
+	for _, path := range []string{open, locked} {
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkSocketAccess(open); err != nil {
+		t.Errorf("accessible socket: %v", err)
+	}
+	// the dialer waits for it to turn up
+	if err := checkSocketAccess(filepath.Join(dir, "missing.sock")); err != nil {
+		t.Errorf("missing socket: %v", err)
+	}
+
+	if os.Geteuid() == 0 {
+		// TestSocketAccessError covers the message
+		t.Skip("root can read and write anything")
+	}
+	err = checkSocketAccess(locked)
+	if err == nil {
+		t.Fatal("got no error for a socket without access")
+	}
+	for _, want := range []string{locked, "group"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("got %q, want it to mention %q", err.Error(), want)
+		}
+	}
+}
+
+func TestSocketAccessError(t *testing.T) {
+	const path = "/var/run/docker.sock"
+	tests := []struct {
+		name    string
+		err     error
+		wantErr bool
+	}{
+		{name: "accessible"},
+		{name: "no access", err: syscall.EACCES, wantErr: true},
+		{name: "not permitted", err: syscall.EPERM, wantErr: true},
+		{name: "wrapped", err: fmt.Errorf("access: %w", syscall.EACCES), wantErr: true},
+		// for the dialer to deal with
+		{name: "missing", err: syscall.ENOENT},
+		{name: "not a directory", err: syscall.ENOTDIR},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := socketAccessError(path, tt.err)
+			if !tt.wantErr {
+				if err != nil {
+					t.Errorf("got %v, want none", err)
+				}
+				return
+			}
+			want := "permission denied on docker socket /var/run/docker.sock - run as root, or as a member of the group that owns it (usually docker)"
+			if err == nil || err.Error() != want {
+				t.Errorf("got %v, want %q", err, want)
+			}
+		})
+	}
+}
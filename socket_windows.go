@@ -0,0 +1,6 @@
+package main
+
+func checkSocketAccess(path string) error {
+	// named pipes are secured by ACLs, which the engine reports clearly enough itself
+	return nil
+}